@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// pauser stops and starts consuming from the queue.
+type pauser interface {
+	pause() error
+	resume() error
+	isPaused() bool
+}
+
+// adminState is returned from the pause and resume endpoints.
+type adminState struct {
+	Paused bool `json:"paused"`
+}
+
+// registerAdmin adds the admin API to mux, each request must present token
+// as a bearer token.
+func registerAdmin(mux *http.ServeMux, token string, queue pauser, w *worker) {
+	mux.Handle("POST /admin/pause", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		if err := queue.pause(); err != nil {
+			log.Printf("Error pausing: %s", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(rw, adminState{Paused: queue.isPaused()})
+	}))
+
+	mux.Handle("POST /admin/resume", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		if err := queue.resume(); err != nil {
+			log.Printf("Error resuming: %s", err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(rw, adminState{Paused: queue.isPaused()})
+	}))
+
+	mux.Handle("GET /admin/state", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, adminState{Paused: queue.isPaused()})
+	}))
+
+	mux.Handle("GET /admin/inflight", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, w.Invocations())
+	}))
+
+	mux.Handle("GET /admin/circuits", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, w.breakers.States())
+	}))
+
+	mux.Handle("GET /admin/config", requireToken(token, func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, w.Config().Redacted())
+	}))
+}
+
+// requireTokenIfSet protects the results and status of invocations with the
+// admin API's token, they are served to anyone who can reach http_port when
+// it isn't set.
+func requireTokenIfSet(token string, next http.HandlerFunc) http.HandlerFunc {
+	if len(token) == 0 {
+		return next
+	}
+
+	return requireToken(token, next)
+}
+
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %s", err)
+	}
+}
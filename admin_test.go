@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakePauser struct {
+	paused bool
+}
+
+func (f *fakePauser) pause() error {
+	f.paused = true
+	return nil
+}
+
+func (f *fakePauser) resume() error {
+	f.paused = false
+	return nil
+}
+
+func (f *fakePauser) isPaused() bool {
+	return f.paused
+}
+
+func Test_registerAdmin_RequiresToken(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAdmin(mux, "secret", &fakePauser{}, newWorker(QueueWorkerConfig{}, nil, nil))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/pause", nil))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("want status 401, got %d", rr.Code)
+	}
+}
+
+func Test_registerAdmin_PauseResume(t *testing.T) {
+	queue := &fakePauser{}
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, "secret", queue, newWorker(QueueWorkerConfig{}, nil, nil))
+
+	for _, c := range []struct {
+		path       string
+		wantPaused bool
+	}{
+		{"/admin/pause", true},
+		{"/admin/resume", false},
+	} {
+		req := httptest.NewRequest(http.MethodPost, c.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s want status 200, got %d", c.path, rr.Code)
+		}
+
+		state := adminState{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+
+		if state.Paused != c.wantPaused || queue.paused != c.wantPaused {
+			t.Errorf("%s want paused %v, got %v", c.path, c.wantPaused, state.Paused)
+		}
+	}
+}
+
+func Test_registerAdmin_Inflight(t *testing.T) {
+	w := newWorker(QueueWorkerConfig{}, nil, nil)
+	done := w.track(Invocation{ID: 1, Function: "figlet", Started: time.Now().Add(-time.Second)})
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, "secret", &fakePauser{}, w)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/inflight", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	invocations := []Invocation{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &invocations); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invocations) != 1 || invocations[0].Function != "figlet" {
+		t.Fatalf("want figlet in progress, got %+v", invocations)
+	}
+
+	done()
+
+	if len(w.Invocations()) != 0 {
+		t.Errorf("want no invocations in progress once done")
+	}
+}
+
+func Test_registerAdmin_ConfigOmitsToken(t *testing.T) {
+	config := QueueWorkerConfig{AdminToken: "secret", GatewayAddress: "gateway"}
+
+	mux := http.NewServeMux()
+	registerAdmin(mux, "secret", &fakePauser{}, newWorker(config, nil, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := got["AdminToken"]; ok {
+		t.Errorf("want AdminToken to be omitted from the config")
+	}
+
+	if got["GatewayAddress"] != "gateway" {
+		t.Errorf("want GatewayAddress gateway, got %v", got["GatewayAddress"])
+	}
+}
+
+func Test_requireTokenIfSet(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	cases := []struct {
+		token, given string
+		want         int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/results/call-1", nil)
+		if len(c.given) > 0 {
+			req.Header.Set("Authorization", c.given)
+		}
+
+		rr := httptest.NewRecorder()
+		requireTokenIfSet(c.token, ok)(rr, req)
+
+		if rr.Code != c.want {
+			t.Errorf("token %q given %q: want %d, got %d", c.token, c.given, c.want, rr.Code)
+		}
+	}
+}
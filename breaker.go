@@ -0,0 +1,266 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a function's circuit breaker.
+type BreakerState string
+
+const (
+	// BreakerClosed invokes the function as normal.
+	BreakerClosed BreakerState = "closed"
+
+	// BreakerOpen defers messages for the function without invoking it.
+	BreakerOpen BreakerState = "open"
+
+	// BreakerHalfOpen lets a limited number of trial invocations through
+	// to find out whether the function has recovered.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+const (
+	DefaultCircuitFailureThreshold = 5
+	DefaultCircuitFailureRate      = 0.5
+	DefaultCircuitMinRequests      = 10
+	DefaultCircuitWindow           = time.Minute
+	DefaultCircuitOpenDuration     = time.Second * 30
+)
+
+// CircuitBreakerConfig controls when a function's circuit opens.
+type CircuitBreakerConfig struct {
+	// Enabled turns on a circuit breaker for each function.
+	Enabled bool
+
+	// FailureThreshold opens the circuit after this many consecutive
+	// failures.
+	FailureThreshold int
+
+	// FailureRate opens the circuit when this fraction of the invocations
+	// within Window failed, once there were at least MinRequests.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+
+	// OpenDuration is how long the circuit stays open before a trial
+	// invocation is let through.
+	OpenDuration time.Duration
+
+	// HoldingChannel receives messages whilst the circuit is open, when
+	// empty they are left unacked to be redelivered after ack_wait.
+	HoldingChannel string
+}
+
+// circuitBreaker tracks the failures of a single function.
+type circuitBreaker struct {
+	state       BreakerState
+	consecutive int
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	trial       bool
+}
+
+// circuitBreakers holds a circuit breaker for each function, they are kept
+// when the config is reloaded.
+type circuitBreakers struct {
+	lock     sync.Mutex
+	config   CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+
+	// onChange is called with the lock held whenever a circuit changes
+	// state.
+	onChange func(function string, from, to BreakerState)
+}
+
+func newCircuitBreakers(config CircuitBreakerConfig) *circuitBreakers {
+	return &circuitBreakers{
+		config:   config,
+		breakers: map[string]*circuitBreaker{},
+		onChange: logBreakerChange,
+	}
+}
+
+// Configure applies a new config, the state of each circuit is kept.
+func (c *circuitBreakers) Configure(config CircuitBreakerConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.config = config
+}
+
+// Allow returns true when the function can be invoked. Once the circuit has
+// been open for OpenDuration, a single trial invocation is allowed at a time.
+func (c *circuitBreakers) Allow(function string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.config.Enabled {
+		return true
+	}
+
+	b := c.get(function, now)
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < c.config.OpenDuration {
+			return false
+		}
+
+		c.transition(function, b, BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+
+		b.trial = true
+	}
+
+	return true
+}
+
+// Record updates the function's circuit with the outcome of an invocation.
+func (c *circuitBreakers) Record(function string, success bool, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.config.Enabled {
+		return
+	}
+
+	b := c.get(function, now)
+
+	if b.state == BreakerHalfOpen {
+		b.trial = false
+
+		if success {
+			c.transition(function, b, BreakerClosed, now)
+		} else {
+			c.transition(function, b, BreakerOpen, now)
+		}
+
+		return
+	}
+
+	if b.state == BreakerOpen {
+		return
+	}
+
+	if now.Sub(b.windowStart) > c.config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	b.requests++
+
+	if success {
+		b.consecutive = 0
+		return
+	}
+
+	b.failures++
+	b.consecutive++
+
+	tripped := c.config.FailureThreshold > 0 && b.consecutive >= c.config.FailureThreshold
+	if c.config.FailureRate > 0 && b.requests >= c.config.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= c.config.FailureRate {
+		tripped = true
+	}
+
+	if tripped {
+		c.transition(function, b, BreakerOpen, now)
+	}
+}
+
+// States returns the state of each function's circuit.
+func (c *circuitBreakers) States() []circuitStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	states := make([]circuitStatus, 0, len(c.breakers))
+	for function, b := range c.breakers {
+		state := circuitStatus{
+			Function:    function,
+			State:       b.state,
+			Consecutive: b.consecutive,
+			Requests:    b.requests,
+			Failures:    b.failures,
+		}
+
+		if b.state != BreakerClosed {
+			openedAt := b.openedAt
+			state.OpenedAt = &openedAt
+		}
+
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Function < states[j].Function
+	})
+
+	return states
+}
+
+// circuitStatus is returned from GET /admin/circuits.
+type circuitStatus struct {
+	Function    string       `json:"function"`
+	State       BreakerState `json:"state"`
+	Consecutive int          `json:"consecutiveFailures"`
+	Requests    int          `json:"requests"`
+	Failures    int          `json:"failures"`
+	OpenedAt    *time.Time   `json:"openedAt,omitempty"`
+}
+
+func (c *circuitBreakers) get(function string, now time.Time) *circuitBreaker {
+	b, ok := c.breakers[function]
+	if !ok {
+		b = &circuitBreaker{state: BreakerClosed, windowStart: now}
+		c.breakers[function] = b
+	}
+
+	return b
+}
+
+func (c *circuitBreakers) transition(function string, b *circuitBreaker, to BreakerState, now time.Time) {
+	from := b.state
+	b.state = to
+
+	switch to {
+	case BreakerOpen:
+		b.openedAt = now
+	case BreakerClosed:
+		b.consecutive = 0
+		b.requests = 0
+		b.failures = 0
+		b.windowStart = now
+	}
+
+	if c.onChange != nil {
+		c.onChange(function, from, to)
+	}
+}
+
+func logBreakerChange(function string, from, to BreakerState) {
+	log.Printf("Circuit for %s changed from %s to %s", function, from, to)
+
+	circuitState.WithLabelValues(function).Set(breakerStateValue(to))
+}
+
+// breakerStateValue is exported in the queue_worker_circuit_state metric.
+func breakerStateValue(state BreakerState) float64 {
+	switch state {
+	case BreakerOpen:
+		return 1
+	case BreakerHalfOpen:
+		return 2
+	}
+
+	return 0
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+func newTestBreakers(config CircuitBreakerConfig) (*circuitBreakers, *[]BreakerState) {
+	config.Enabled = true
+
+	changes := []BreakerState{}
+	c := newCircuitBreakers(config)
+	c.onChange = func(function string, from, to BreakerState) {
+		changes = append(changes, to)
+	}
+
+	return c, &changes
+}
+
+func Test_circuitBreakers_OpensAfterConsecutiveFailures(t *testing.T) {
+	c, changes := newTestBreakers(CircuitBreakerConfig{FailureThreshold: 3, Window: time.Minute, OpenDuration: time.Second * 30})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !c.Allow("figlet", now) {
+			t.Fatalf("want invocation %d allowed", i+1)
+		}
+
+		c.Record("figlet", false, now)
+	}
+
+	if c.Allow("figlet", now) {
+		t.Errorf("want circuit open after 3 consecutive failures")
+	}
+
+	if !c.Allow("nodeinfo", now) {
+		t.Errorf("want other functions unaffected")
+	}
+
+	if len(*changes) != 1 || (*changes)[0] != BreakerOpen {
+		t.Errorf("want a change to open, got %v", *changes)
+	}
+}
+
+func Test_circuitBreakers_OpensOnFailureRate(t *testing.T) {
+	c, _ := newTestBreakers(CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 4, Window: time.Minute, OpenDuration: time.Second * 30})
+	now := time.Now()
+
+	for _, success := range []bool{true, false, true} {
+		c.Record("figlet", success, now)
+	}
+
+	if !c.Allow("figlet", now) {
+		t.Fatalf("want circuit closed before MinRequests")
+	}
+
+	c.Record("figlet", false, now)
+
+	if c.Allow("figlet", now) {
+		t.Errorf("want circuit open with 2 of 4 failed")
+	}
+}
+
+func Test_circuitBreakers_FailureRateWindowResets(t *testing.T) {
+	c, _ := newTestBreakers(CircuitBreakerConfig{FailureRate: 0.5, MinRequests: 2, Window: time.Minute})
+	now := time.Now()
+
+	c.Record("figlet", false, now)
+	c.Record("figlet", true, now.Add(time.Minute*2))
+
+	if !c.Allow("figlet", now.Add(time.Minute*2)) {
+		t.Errorf("want failures from a previous window forgotten")
+	}
+}
+
+func Test_circuitBreakers_HalfOpen(t *testing.T) {
+	c, changes := newTestBreakers(CircuitBreakerConfig{FailureThreshold: 1, Window: time.Minute, OpenDuration: time.Second * 30})
+	now := time.Now()
+
+	c.Record("figlet", false, now)
+
+	later := now.Add(time.Second * 31)
+	if !c.Allow("figlet", later) {
+		t.Fatalf("want a trial allowed after OpenDuration")
+	}
+
+	if c.Allow("figlet", later) {
+		t.Errorf("want only one trial at a time")
+	}
+
+	c.Record("figlet", false, later)
+
+	if c.Allow("figlet", later.Add(time.Second)) {
+		t.Errorf("want circuit open again after a failed trial")
+	}
+
+	latest := later.Add(time.Second * 31)
+	if !c.Allow("figlet", latest) {
+		t.Fatalf("want another trial allowed")
+	}
+
+	c.Record("figlet", true, latest)
+
+	if !c.Allow("figlet", latest) || !c.Allow("figlet", latest) {
+		t.Errorf("want circuit closed after a successful trial")
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(*changes) != len(want) {
+		t.Fatalf("want changes %v, got %v", want, *changes)
+	}
+
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Errorf("change %d want %s, got %s", i, want[i], (*changes)[i])
+		}
+	}
+}
+
+func Test_worker_handle_BusyFunctionKeepsTrial(t *testing.T) {
+	w := newWorker(QueueWorkerConfig{
+		DefaultNamespace: "openfaas-fn",
+		AckWait:          100 * time.Millisecond,
+		CircuitBreaker:   CircuitBreakerConfig{Enabled: true, FailureThreshold: 1, Window: time.Minute, OpenDuration: time.Second},
+		Functions:        map[string]FunctionConfig{"figlet": {MaxInflight: 1}},
+	}, nil, nil)
+
+	// Opened long enough ago for the next message to be the trial.
+	w.breakers.Record("figlet", false, time.Now().Add(-time.Minute))
+
+	release, ok := w.functions.Acquire("figlet", 0)
+	if !ok {
+		t.Fatal("want the function's slot")
+	}
+
+	msg := &stan.Msg{MsgProto: pb.MsgProto{Data: []byte(`{"Function":"figlet"}`)}}
+	if w.handle(msg) {
+		t.Fatal("want the message left for redelivery whilst the function is busy")
+	}
+
+	release()
+
+	if !w.breakers.Allow("figlet", time.Now()) {
+		t.Error("want the trial kept for when the function has capacity")
+	}
+}
+
+func Test_circuitBreakers_Disabled(t *testing.T) {
+	c := newCircuitBreakers(CircuitBreakerConfig{FailureThreshold: 1})
+	now := time.Now()
+
+	c.Record("figlet", false, now)
+
+	if !c.Allow("figlet", now) || len(c.States()) != 0 {
+		t.Errorf("want nothing tracked when disabled")
+	}
+}
+
+func Test_circuitBreakers_States(t *testing.T) {
+	c, _ := newTestBreakers(CircuitBreakerConfig{FailureThreshold: 1, Window: time.Minute, OpenDuration: time.Second * 30})
+	now := time.Now()
+
+	c.Record("nodeinfo", true, now)
+	c.Record("figlet", false, now)
+
+	states := c.States()
+	if len(states) != 2 || states[0].Function != "figlet" || states[0].State != BreakerOpen || states[0].OpenedAt == nil {
+		t.Fatalf("want figlet open first, got %+v", states)
+	}
+
+	if states[1].State != BreakerClosed || states[1].OpenedAt != nil {
+		t.Errorf("want nodeinfo closed, got %+v", states[1])
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+// CallbackPolicy restricts where the results of invocations can be posted.
+type CallbackPolicy struct {
+	// AllowedSchemes for callback URLs, i.e. http and https.
+	AllowedSchemes []string
+
+	// AllowedHosts when set, only allows callbacks to these hosts. A
+	// leading "*." matches any subdomain.
+	AllowedHosts []string
+
+	// DeniedHosts rejects callbacks to these hosts.
+	DeniedHosts []string
+
+	// AllowedCIDRs when set, only allows callbacks to addresses within
+	// these ranges. They are also exempt from BlockPrivate.
+	AllowedCIDRs []*net.IPNet
+
+	// DeniedCIDRs rejects callbacks to addresses within these ranges.
+	DeniedCIDRs []*net.IPNet
+
+	// BlockPrivate rejects callbacks to private, loopback and link-local
+	// addresses, this is checked after DNS resolution.
+	BlockPrivate bool
+
+	// MaxRedirects is the number of redirects followed for a callback.
+	MaxRedirects int
+
+	// AllowedSubjects when set, only allows results to be published to
+	// these NATS subjects. A trailing ">" matches any subject with the
+	// given prefix.
+	AllowedSubjects []string
+
+	// ReservedSubjects are used by the worker, such as the status subject
+	// and the circuit breaker's holding channel, so results can't be
+	// published to them.
+	ReservedSubjects []string
+}
+
+// callbackRejectedError is returned when a callback is not allowed by the
+// CallbackPolicy.
+type callbackRejectedError struct {
+	reason string
+}
+
+func (e *callbackRejectedError) Error() string {
+	return "callback rejected: " + e.reason
+}
+
+func rejectCallback(format string, a ...interface{}) error {
+	return &callbackRejectedError{reason: fmt.Sprintf(format, a...)}
+}
+
+// CheckURL validates the scheme and host of a callback URL.
+func (p CallbackPolicy) CheckURL(u *url.URL) error {
+	if len(p.AllowedSchemes) > 0 && !contains(p.AllowedSchemes, strings.ToLower(u.Scheme)) {
+		return rejectCallback("scheme %q is not allowed", u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if len(host) == 0 {
+		return rejectCallback("no host given")
+	}
+
+	if matchHost(p.DeniedHosts, host) {
+		return rejectCallback("host %q is denied", host)
+	}
+
+	if len(p.AllowedHosts) > 0 && !matchHost(p.AllowedHosts, host) {
+		return rejectCallback("host %q is not allowed", host)
+	}
+
+	// Literal IPs are checked here too, so that they are rejected before
+	// connecting.
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	return nil
+}
+
+// CheckIP validates an address which a callback is about to connect to.
+func (p CallbackPolicy) CheckIP(ip net.IP) error {
+	if matchCIDR(p.DeniedCIDRs, ip) {
+		return rejectCallback("address %s is denied", ip)
+	}
+
+	allowed := matchCIDR(p.AllowedCIDRs, ip)
+	if len(p.AllowedCIDRs) > 0 && !allowed {
+		return rejectCallback("address %s is not allowed", ip)
+	}
+
+	if p.BlockPrivate && !allowed && isPrivateIP(ip) {
+		return rejectCallback("address %s is private", ip)
+	}
+
+	return nil
+}
+
+// checksIPs returns true when CheckIP can reject an address.
+func (p CallbackPolicy) checksIPs() bool {
+	return p.BlockPrivate || len(p.AllowedCIDRs) > 0 || len(p.DeniedCIDRs) > 0
+}
+
+// CheckSubject validates a NATS subject or NATS Streaming channel which a
+// result is about to be published to. Internal subjects, the queue, the
+// default status subject and ReservedSubjects are always rejected, so that a
+// caller can't queue requests or spoof status events.
+func (p CallbackPolicy) CheckSubject(subject string) error {
+	if len(subject) == 0 || strings.ContainsAny(subject, "*> \t") {
+		return rejectCallback("subject %q is invalid", subject)
+	}
+
+	if strings.HasPrefix(subject, "_") || subject == sharedQueue || subject == lifecycle.DefaultSubject || contains(p.ReservedSubjects, subject) {
+		return rejectCallback("subject %q is reserved", subject)
+	}
+
+	if len(p.AllowedSubjects) == 0 {
+		return nil
+	}
+
+	for _, allowed := range p.AllowedSubjects {
+		if allowed == subject {
+			return nil
+		}
+
+		if strings.HasSuffix(allowed, ">") && strings.HasPrefix(subject, strings.TrimSuffix(allowed, ">")) {
+			return nil
+		}
+	}
+
+	return rejectCallback("subject %q is not allowed", subject)
+}
+
+// makeCallbackClient constructs a HTTP client for posting results which
+// enforces the policy for each connection and redirect. When the policy
+// checks addresses, callbacks don't use HTTP_PROXY, as it would check the
+// proxy's address rather than the callback's.
+func makeCallbackClient(policy CallbackPolicy) http.Client {
+	client := makeClient()
+
+	tr := client.Transport.(*http.Transport)
+	if policy.checksIPs() {
+		tr.Proxy = nil
+	}
+	tr.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 0,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return rejectCallback("unable to parse address %s", address)
+			}
+
+			return policy.CheckIP(ip)
+		},
+	}).DialContext
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > policy.MaxRedirects {
+			return rejectCallback("stopped after %d redirects", policy.MaxRedirects)
+		}
+
+		return policy.CheckURL(req.URL)
+	}
+
+	return client
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified()
+}
+
+func matchHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if h == host {
+			return true
+		}
+
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchCIDR(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCIDRs parses a list of CIDRs, a single address is treated as a /32
+// or /128.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs, nil
+}
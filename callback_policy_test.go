@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func Test_CallbackPolicy_CheckURL_RejectsScheme(t *testing.T) {
+	policy := CallbackPolicy{AllowedSchemes: []string{"http", "https"}}
+
+	u, _ := url.Parse("file:///etc/passwd")
+	if err := policy.CheckURL(u); err == nil {
+		t.Errorf("want file scheme to be rejected")
+	}
+}
+
+func Test_CallbackPolicy_CheckURL_AllowedHosts(t *testing.T) {
+	policy := CallbackPolicy{AllowedHosts: []string{"*.example.com", "gateway"}}
+
+	for _, allowed := range []string{"http://api.example.com/cb", "http://gateway:8080/function/cb"} {
+		u, _ := url.Parse(allowed)
+		if err := policy.CheckURL(u); err != nil {
+			t.Errorf("want %s to be allowed, got: %s", allowed, err)
+		}
+	}
+
+	u, _ := url.Parse("http://example.org/cb")
+	if err := policy.CheckURL(u); err == nil {
+		t.Errorf("want example.org to be rejected")
+	}
+}
+
+func Test_CallbackPolicy_CheckURL_DeniedHosts(t *testing.T) {
+	policy := CallbackPolicy{DeniedHosts: []string{"metadata.google.internal"}}
+
+	u, _ := url.Parse("http://metadata.google.internal/computeMetadata/v1/")
+	if err := policy.CheckURL(u); err == nil {
+		t.Errorf("want metadata.google.internal to be rejected")
+	}
+}
+
+func Test_CallbackPolicy_CheckIP(t *testing.T) {
+	denied, _ := parseCIDRs([]string{"169.254.169.254"})
+	allowed, _ := parseCIDRs([]string{"10.0.1.0/24"})
+
+	policy := CallbackPolicy{
+		DeniedCIDRs:  denied,
+		BlockPrivate: true,
+	}
+
+	cases := map[string]bool{
+		"169.254.169.254": false,
+		"127.0.0.1":       false,
+		"10.0.1.5":        false,
+		"::1":             false,
+		"8.8.8.8":         true,
+	}
+
+	for ip, want := range cases {
+		got := policy.CheckIP(net.ParseIP(ip)) == nil
+		if got != want {
+			t.Errorf("%s want allowed %v, got %v", ip, want, got)
+		}
+	}
+
+	policy.AllowedCIDRs = allowed
+	if err := policy.CheckIP(net.ParseIP("10.0.1.5")); err != nil {
+		t.Errorf("want 10.0.1.5 to be allowed by allowed CIDRs, got: %s", err)
+	}
+
+	if err := policy.CheckIP(net.ParseIP("8.8.8.8")); err == nil {
+		t.Errorf("want 8.8.8.8 to be rejected when outside allowed CIDRs")
+	}
+}
+
+func Test_makeCallbackClient_RejectsPrivateAddressOnDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	client := makeCallbackClient(CallbackPolicy{BlockPrivate: true})
+
+	_, err := postResult(&client, nil, nil, nil, srv.URL, "", http.StatusOK, "figlet", 0.1)
+
+	var rejected *callbackRejectedError
+	if !errors.As(err, &rejected) {
+		t.Errorf("want callbackRejectedError, got: %v", err)
+	}
+}
+
+func Test_makeCallbackClient_IgnoresProxy(t *testing.T) {
+	client := makeCallbackClient(CallbackPolicy{BlockPrivate: true})
+
+	// The dialer would check the proxy's address rather than the callback's.
+	if client.Transport.(*http.Transport).Proxy != nil {
+		t.Errorf("want callbacks sent directly, not through a proxy")
+	}
+
+	for _, policy := range []CallbackPolicy{{AllowedCIDRs: []*net.IPNet{}}, {AllowedHosts: []string{"example.com"}}} {
+		client := makeCallbackClient(policy)
+
+		if client.Transport.(*http.Transport).Proxy == nil {
+			t.Errorf("want HTTP_PROXY kept without address rules, policy: %+v", policy)
+		}
+	}
+}
+
+func Test_makeCallbackClient_LimitsRedirects(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	client := makeCallbackClient(CallbackPolicy{MaxRedirects: 2})
+
+	_, err := postResult(&client, nil, nil, nil, srv.URL, "", http.StatusOK, "figlet", 0.1)
+
+	var rejected *callbackRejectedError
+	if !errors.As(err, &rejected) {
+		t.Errorf("want callbackRejectedError, got: %v", err)
+	}
+}
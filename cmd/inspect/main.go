@@ -0,0 +1,122 @@
+// Command inspect dumps and summarizes the requests in a NATS Streaming
+// channel. It reads through a temporary non-durable subscription, so no
+// durable is acked or created.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+func main() {
+	var (
+		natsURL        string
+		clusterID      string
+		channel        string
+		startSeq       uint64
+		since          time.Duration
+		limit          int
+		format         string
+		summaryOnly    bool
+		idleTimeout    time.Duration
+		connectTimeout time.Duration
+	)
+
+	flag.StringVar(&natsURL, "nats-url", "nats://nats:4222", "URL of the NATS Streaming server, or a comma separated list of URLs")
+	flag.StringVar(&clusterID, "cluster", "faas-cluster", "NATS Streaming cluster ID")
+	flag.StringVar(&channel, "channel", "faas-request", "channel to inspect")
+	flag.Uint64Var(&startSeq, "start-seq", 0, "read from this sequence, defaults to all available")
+	flag.DurationVar(&since, "since", 0, "read requests queued within this duration, i.e. 1h")
+	flag.IntVar(&limit, "limit", 0, "stop after this many requests, zero means no limit")
+	flag.StringVar(&format, "format", "table", "output as table or json")
+	flag.BoolVar(&summaryOnly, "summary", false, "only print the counts by function and age")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Second*5, "stop once no messages are received for this long")
+	flag.DurationVar(&connectTimeout, "connect-timeout", time.Second*2, "how long to wait for the connection to NATS Streaming")
+	flag.Parse()
+
+	if format != "table" && format != "json" {
+		log.Fatalf("-format must be table or json, got: %s", format)
+	}
+
+	start := stan.DeliverAllAvailable()
+	if startSeq > 0 {
+		start = stan.StartAtSequence(startSeq)
+	} else if since > 0 {
+		start = stan.StartAtTimeDelta(since)
+	}
+
+	hostname, _ := os.Hostname()
+	clientID := nats.NewClientID("faas-inspect-", hostname, nats.ClientIDUnique)
+
+	connect := nats.ConnectOptions{ConnectTimeout: connectTimeout}
+
+	conn, err := stan.Connect(clusterID, clientID, connect.StanOptions(natsURL)...)
+	if err != nil {
+		log.Fatalf("Can't connect to %s: %s", natsURL, err)
+	}
+	defer conn.Close()
+
+	msgs := make(chan *stan.Msg)
+	done := make(chan struct{})
+
+	sub, err := conn.Subscribe(channel, func(msg *stan.Msg) {
+		select {
+		case msgs <- msg:
+		case <-done:
+		}
+	}, start)
+	if err != nil {
+		log.Fatalf("Couldn't subscribe to %s: %s", channel, err)
+	}
+
+	// Requests queued after inspecting started are not included.
+	now := time.Now()
+
+	var records []record
+
+	for limit == 0 || len(records) < limit {
+		var msg *stan.Msg
+
+		select {
+		case msg = <-msgs:
+		case <-time.After(idleTimeout):
+		}
+
+		if msg == nil {
+			break
+		}
+
+		queued := time.Unix(0, msg.Timestamp)
+		if queued.After(now) {
+			break
+		}
+
+		req := ftypes.QueueRequest{}
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Printf("[%d] Unmarshal error: %s", msg.Sequence, err)
+			continue
+		}
+
+		records = append(records, newRecord(msg.Sequence, queued, now, &req))
+	}
+
+	close(done)
+	sub.Unsubscribe()
+
+	if !summaryOnly {
+		if err := writeRecords(os.Stdout, format, records); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := writeSummary(os.Stdout, format, summarize(records)); err != nil {
+		log.Fatal(err)
+	}
+}
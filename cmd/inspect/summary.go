@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// record describes a queued request.
+type record struct {
+	Sequence    uint64            `json:"sequence"`
+	Function    string            `json:"function"`
+	CallID      string            `json:"callId,omitempty"`
+	Size        int               `json:"size"`
+	Queued      time.Time         `json:"queued"`
+	Age         string            `json:"age"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	age time.Duration
+}
+
+func newRecord(sequence uint64, queued, now time.Time, req *ftypes.QueueRequest) record {
+	age := now.Sub(queued)
+
+	return record{
+		Sequence:    sequence,
+		Function:    strings.Trim(req.Function, "/"),
+		CallID:      req.Header.Get("X-Call-Id"),
+		Size:        len(req.Body),
+		Queued:      queued,
+		Age:         age.Round(time.Second).String(),
+		Annotations: req.Annotations,
+		age:         age,
+	}
+}
+
+// ageBucket is a range of ages which requests are counted in.
+type ageBucket struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+
+	max time.Duration
+}
+
+// newAgeBuckets returns the buckets in ascending order, the last has no
+// upper bound.
+func newAgeBuckets() []ageBucket {
+	return []ageBucket{
+		{Name: "<1m", max: time.Minute},
+		{Name: "1m-10m", max: time.Minute * 10},
+		{Name: "10m-1h", max: time.Hour},
+		{Name: "1h-24h", max: time.Hour * 24},
+		{Name: ">24h"},
+	}
+}
+
+// functionSummary aggregates the requests for a function.
+type functionSummary struct {
+	Function string `json:"function"`
+	Count    int    `json:"count"`
+	Bytes    int    `json:"bytes"`
+	Oldest   string `json:"oldest"`
+
+	oldest time.Duration
+}
+
+// summary aggregates requests by function and by age, so that a backlog
+// can be triaged.
+type summary struct {
+	Total     int               `json:"total"`
+	Bytes     int               `json:"bytes"`
+	Functions []functionSummary `json:"functions"`
+	Ages      []ageBucket       `json:"ages"`
+}
+
+func summarize(records []record) summary {
+	s := summary{Ages: newAgeBuckets()}
+	functions := map[string]*functionSummary{}
+
+	for _, r := range records {
+		s.Total++
+		s.Bytes += r.Size
+
+		f, ok := functions[r.Function]
+		if !ok {
+			f = &functionSummary{Function: r.Function}
+			functions[r.Function] = f
+		}
+
+		f.Count++
+		f.Bytes += r.Size
+		if r.age > f.oldest {
+			f.oldest = r.age
+			f.Oldest = r.Age
+		}
+
+		for i := range s.Ages {
+			if s.Ages[i].max == 0 || r.age < s.Ages[i].max {
+				s.Ages[i].Count++
+				break
+			}
+		}
+	}
+
+	for _, f := range functions {
+		s.Functions = append(s.Functions, *f)
+	}
+
+	// The largest backlogs are listed first.
+	sort.Slice(s.Functions, func(i, j int) bool {
+		if s.Functions[i].Count != s.Functions[j].Count {
+			return s.Functions[i].Count > s.Functions[j].Count
+		}
+
+		return s.Functions[i].Function < s.Functions[j].Function
+	})
+
+	return s
+}
+
+func writeRecords(w io.Writer, format string, records []record) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(records)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tFUNCTION\tCALL ID\tSIZE\tAGE\tANNOTATIONS")
+
+	for _, r := range records {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\n", r.Sequence, r.Function, r.CallID, r.Size, r.Age, formatAnnotations(r.Annotations))
+	}
+
+	return tw.Flush()
+}
+
+func writeSummary(w io.Writer, format string, s summary) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(s)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tCOUNT\tBYTES\tOLDEST")
+
+	for _, f := range s.Functions {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", f.Function, f.Count, f.Bytes, f.Oldest)
+	}
+
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t\n", s.Total, s.Bytes)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "AGE\tCOUNT")
+
+	for _, b := range s.Ages {
+		fmt.Fprintf(tw, "%s\t%d\n", b.Name, b.Count)
+	}
+
+	return tw.Flush()
+}
+
+func formatAnnotations(annotations map[string]string) string {
+	pairs := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		pairs = append(pairs, k+"="+v)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+func makeRecords(now time.Time) []record {
+	requests := []struct {
+		function string
+		age      time.Duration
+		size     int
+	}{
+		{"figlet", time.Second * 30, 10},
+		{"figlet", time.Minute * 5, 20},
+		{"/nodeinfo/", time.Hour * 2, 5},
+		{"figlet", time.Hour * 48, 1},
+	}
+
+	var records []record
+	for i, r := range requests {
+		req := &ftypes.QueueRequest{
+			Function: r.function,
+			Header:   http.Header{"X-Call-Id": []string{"call-" + r.function}},
+			Body:     make([]byte, r.size),
+		}
+
+		records = append(records, newRecord(uint64(i+1), now.Add(-r.age), now, req))
+	}
+
+	return records
+}
+
+func Test_summarize(t *testing.T) {
+	s := summarize(makeRecords(time.Now()))
+
+	if s.Total != 4 || s.Bytes != 36 {
+		t.Errorf("want 4 requests of 36 bytes, got %d of %d", s.Total, s.Bytes)
+	}
+
+	if len(s.Functions) != 2 || s.Functions[0].Function != "figlet" || s.Functions[0].Count != 3 {
+		t.Fatalf("want figlet first with 3 requests, got %+v", s.Functions)
+	}
+
+	if s.Functions[0].Oldest != "48h0m0s" {
+		t.Errorf("want oldest figlet 48h0m0s, got %s", s.Functions[0].Oldest)
+	}
+
+	if s.Functions[1].Function != "nodeinfo" {
+		t.Errorf("want nodeinfo with slashes trimmed, got %s", s.Functions[1].Function)
+	}
+
+	want := map[string]int{"<1m": 1, "1m-10m": 1, "10m-1h": 0, "1h-24h": 1, ">24h": 1}
+	for _, b := range s.Ages {
+		if b.Count != want[b.Name] {
+			t.Errorf("bucket %s want %d, got %d", b.Name, want[b.Name], b.Count)
+		}
+	}
+}
+
+func Test_writeRecords_Table(t *testing.T) {
+	records := makeRecords(time.Now())
+	records[0].Annotations = map[string]string{"b": "2", "a": "1"}
+
+	out := &bytes.Buffer{}
+	if err := writeRecords(out, "table", records); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "SEQ") {
+		t.Fatalf("want a header and 4 rows, got:\n%s", out)
+	}
+
+	if !strings.Contains(lines[1], "call-figlet") || !strings.Contains(lines[1], "a=1,b=2") {
+		t.Errorf("want call ID and sorted annotations, got: %s", lines[1])
+	}
+}
+
+func Test_writeSummary_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := writeSummary(out, "json", summarize(makeRecords(time.Now()))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := summary{}
+	if err := json.Unmarshal(out.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Total != 4 || len(s.Ages) != 5 {
+		t.Errorf("want 4 requests in 5 buckets, got %d in %d", s.Total, len(s.Ages))
+	}
+}
@@ -0,0 +1,135 @@
+// Command publish enqueues asynchronous invocations without the gateway,
+// for testing and batch jobs. The X-Call-Id of each request is printed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/openfaas/nats-queue-worker/handler"
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+func main() {
+	var (
+		natsAddress string
+		natsPort    int
+		clusterID   string
+		channel     string
+		function    string
+		method      string
+		path        string
+		query       string
+		callbackURL string
+		dataFile    string
+		bulkFile    string
+
+		connectTimeout time.Duration
+	)
+
+	header := &keyValues{sep: ":"}
+	annotations := &keyValues{sep: "="}
+
+	flag.StringVar(&natsAddress, "nats-address", "nats", "address of the NATS Streaming server")
+	flag.IntVar(&natsPort, "nats-port", 4222, "port of the NATS Streaming server")
+	flag.StringVar(&clusterID, "cluster", "faas-cluster", "NATS Streaming cluster ID")
+	flag.StringVar(&channel, "channel", "faas-request", "channel to publish requests to")
+	flag.StringVar(&function, "function", "", "function to invoke, as name or name.namespace")
+	flag.StringVar(&method, "method", "POST", "HTTP method for the invocation")
+	flag.StringVar(&path, "path", "", "path to invoke on the function")
+	flag.StringVar(&query, "query", "", "query string for the invocation")
+	flag.Var(header, "header", "header for the invocation as Key: Value, can be repeated")
+	flag.Var(annotations, "annotation", "annotation for the queue worker as key=value, can be repeated")
+	flag.StringVar(&callbackURL, "callback-url", "", "URL to post the result to")
+	flag.StringVar(&dataFile, "data-file", "", "file to read the body from, - for stdin")
+	flag.StringVar(&bulkFile, "bulk", "", "JSONL file of requests to publish, - for stdin")
+	flag.DurationVar(&connectTimeout, "connect-timeout", time.Second*2, "how long to wait for the connection to NATS Streaming")
+	flag.Parse()
+
+	var requests []publishRequest
+
+	if len(bulkFile) > 0 {
+		r, err := open(bulkFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		requests, err = readRequests(r)
+		r.Close()
+		if err != nil {
+			log.Fatalf("Unable to read %s: %s", bulkFile, err)
+		}
+	} else {
+		body := ""
+		if len(dataFile) > 0 {
+			r, err := open(dataFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			data, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				log.Fatalf("Unable to read %s: %s", dataFile, err)
+			}
+
+			body = string(data)
+		}
+
+		requests = append(requests, publishRequest{
+			Function:    function,
+			Method:      method,
+			Path:        path,
+			Query:       query,
+			Header:      header.values,
+			Annotations: annotations.values,
+			CallbackURL: callbackURL,
+			Body:        body,
+		})
+	}
+
+	// A unique client ID lets several publishers run on the same host.
+	config := handler.NewNATSConfig(
+		handler.WithReconnectDelay(time.Second),
+		handler.WithConnectTimeout(connectTimeout),
+		handler.WithClientIDStrategy(nats.ClientIDUnique),
+	)
+
+	queue, err := handler.CreateNATSQueue(natsAddress, natsPort, clusterID, channel, config)
+	if err != nil {
+		log.Fatalf("Can't connect to NATS: %s", err)
+	}
+
+	failed := 0
+
+	for i, p := range requests {
+		req, err := p.queueRequest()
+		if err == nil {
+			err = queue.Queue(req)
+		}
+
+		if err != nil {
+			failed++
+			log.Printf("Request %d for %s not published: %s", i+1, p.Function, err)
+			continue
+		}
+
+		fmt.Println(req.Header.Get("X-Call-Id"))
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func open(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	return os.Open(path)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nats-io/nuid"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// publishRequest is a request to enqueue, given by flags or as a line of a
+// JSONL file.
+type publishRequest struct {
+	Function    string            `json:"function"`
+	Method      string            `json:"method,omitempty"`
+	Path        string            `json:"path,omitempty"`
+	Query       string            `json:"query,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	CallbackURL string            `json:"callbackUrl,omitempty"`
+	Body        string            `json:"body,omitempty"`
+}
+
+// queueRequest builds the request for the queue, an X-Call-Id is assigned
+// when one isn't given.
+func (p publishRequest) queueRequest() (*ftypes.QueueRequest, error) {
+	if len(p.Function) == 0 {
+		return nil, fmt.Errorf("no function given")
+	}
+
+	req := &ftypes.QueueRequest{
+		Function:    p.Function,
+		Method:      p.Method,
+		Path:        p.Path,
+		QueryString: strings.TrimLeft(p.Query, "?"),
+		Header:      http.Header{},
+		Annotations: p.Annotations,
+		Body:        []byte(p.Body),
+	}
+
+	if len(req.Method) == 0 {
+		req.Method = http.MethodPost
+	}
+
+	for k, v := range p.Header {
+		req.Header.Set(k, v)
+	}
+
+	if len(req.Header.Get("X-Call-Id")) == 0 {
+		req.Header.Set("X-Call-Id", nuid.Next())
+	}
+
+	if len(p.CallbackURL) > 0 {
+		u, err := url.Parse(p.CallbackURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid callback URL %q: %s", p.CallbackURL, err)
+		}
+
+		req.CallbackURL = u
+	}
+
+	return req, nil
+}
+
+// readRequests reads one request per line of a JSONL file, blank lines are
+// skipped.
+func readRequests(r io.Reader) ([]publishRequest, error) {
+	var requests []publishRequest
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		p := publishRequest{}
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		requests = append(requests, p)
+	}
+
+	return requests, scanner.Err()
+}
+
+// keyValues collects repeated flags in the form of key=value, or Key: Value
+// when sep is ":".
+type keyValues struct {
+	sep    string
+	values map[string]string
+}
+
+func (k *keyValues) String() string {
+	pairs := []string{}
+	for key, value := range k.values {
+		pairs = append(pairs, key+k.sep+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (k *keyValues) Set(value string) error {
+	parts := strings.SplitN(value, k.sep, 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return fmt.Errorf("want key%svalue, got %q", k.sep, value)
+	}
+
+	if k.values == nil {
+		k.values = map[string]string{}
+	}
+
+	k.values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+
+	return nil
+}
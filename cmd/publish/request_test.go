@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_publishRequest_queueRequest(t *testing.T) {
+	p := publishRequest{
+		Function:    "figlet.staging-fn",
+		Path:        "/render",
+		Query:       "?font=big",
+		Header:      map[string]string{"content-type": "text/plain"},
+		Annotations: map[string]string{"callback-subject": "results"},
+		CallbackURL: "https://example.com/results",
+		Body:        "hello",
+	}
+
+	req, err := p.queueRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != "POST" || req.QueryString != "font=big" || string(req.Body) != "hello" {
+		t.Errorf("want POST with font=big and hello, got %s with %s and %s", req.Method, req.QueryString, req.Body)
+	}
+
+	if req.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("want Content-Type text/plain, got %s", req.Header.Get("Content-Type"))
+	}
+
+	if len(req.Header.Get("X-Call-Id")) == 0 {
+		t.Errorf("want an X-Call-Id to be assigned")
+	}
+
+	if req.CallbackURL.Host != "example.com" {
+		t.Errorf("want callback to example.com, got %s", req.CallbackURL)
+	}
+}
+
+func Test_publishRequest_queueRequest_KeepsCallID(t *testing.T) {
+	p := publishRequest{Function: "figlet", Header: map[string]string{"X-Call-Id": "abc"}}
+
+	req, err := p.queueRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := req.Header.Get("X-Call-Id"); got != "abc" {
+		t.Errorf("want X-Call-Id abc, got %s", got)
+	}
+}
+
+func Test_publishRequest_queueRequest_RequiresFunction(t *testing.T) {
+	if _, err := (publishRequest{}).queueRequest(); err == nil {
+		t.Errorf("want error when no function is given")
+	}
+}
+
+func Test_readRequests(t *testing.T) {
+	requests, err := readRequests(strings.NewReader(`{"function": "figlet", "body": "one"}
+
+{"function": "nodeinfo", "method": "GET"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 || requests[0].Body != "one" || requests[1].Method != "GET" {
+		t.Errorf("want 2 requests, got %+v", requests)
+	}
+}
+
+func Test_readRequests_InvalidLine(t *testing.T) {
+	_, err := readRequests(strings.NewReader("{\"function\": \"figlet\"}\nnot json\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("want error for line 2, got: %v", err)
+	}
+}
+
+func Test_keyValues_Set(t *testing.T) {
+	header := &keyValues{sep: ":"}
+
+	if err := header.Set("Content-Type: application/json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.values["Content-Type"] != "application/json" {
+		t.Errorf("want Content-Type application/json, got %v", header.values)
+	}
+
+	if err := header.Set("no separator"); err == nil {
+		t.Errorf("want error for a value without a separator")
+	}
+}
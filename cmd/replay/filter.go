@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+// statusFunc returns the last lifecycle state recorded for an invocation.
+type statusFunc func(callID string) (lifecycle.State, error)
+
+// filter selects which queued requests are replayed, empty fields match
+// every request.
+type filter struct {
+	function string
+	callIDs  map[string]bool
+	status   lifecycle.State
+	statusOf statusFunc
+
+	// endSequence and until stop the replay, zero values mean no end.
+	endSequence uint64
+	until       time.Time
+}
+
+// done returns true once msg is beyond the end of the range to replay.
+func (f *filter) done(msg *stan.Msg) bool {
+	if f.endSequence > 0 && msg.Sequence > f.endSequence {
+		return true
+	}
+
+	return !f.until.IsZero() && time.Unix(0, msg.Timestamp).After(f.until)
+}
+
+// match returns true when req should be replayed.
+func (f *filter) match(req *ftypes.QueueRequest) (bool, error) {
+	if len(f.function) > 0 && !matchFunction(f.function, req.Function) {
+		return false, nil
+	}
+
+	callID := req.Header.Get("X-Call-Id")
+
+	if len(f.callIDs) > 0 && !f.callIDs[callID] {
+		return false, nil
+	}
+
+	if len(f.status) == 0 {
+		return true, nil
+	}
+
+	if len(callID) == 0 {
+		return false, nil
+	}
+
+	state, err := f.statusOf(callID)
+	if err != nil {
+		return false, err
+	}
+
+	return state == f.status, nil
+}
+
+// matchFunction compares function names, a name given without a namespace
+// matches the function in any namespace.
+func matchFunction(want, function string) bool {
+	function = strings.Trim(function, "/")
+	if want == function {
+		return true
+	}
+
+	return !strings.Contains(want, ".") && strings.HasPrefix(function, want+".")
+}
+
+// startOption positions the subscription at a sequence or time, a sequence
+// takes precedence.
+func startOption(sequence uint64, since time.Duration, start time.Time) (stan.SubscriptionOption, error) {
+	switch {
+	case sequence > 0:
+		return stan.StartAtSequence(sequence), nil
+	case !start.IsZero():
+		return stan.StartAtTime(start), nil
+	case since > 0:
+		return stan.StartAtTimeDelta(since), nil
+	}
+
+	return nil, fmt.Errorf("give one of -start-seq, -start-time or -since")
+}
+
+// makeStatusFunc looks up the state of invocations from the status endpoint
+// of a queue-worker with track_status enabled.
+func makeStatusFunc(client *http.Client, statusURL string) statusFunc {
+	return func(callID string) (lifecycle.State, error) {
+		res, err := client.Get(strings.TrimSuffix(statusURL, "/") + "/status/" + url.PathEscape(callID))
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+
+		if res.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unexpected status for %s: %d", callID, res.StatusCode)
+		}
+
+		status := struct {
+			State lifecycle.State `json:"state"`
+		}{}
+		if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+			return "", err
+		}
+
+		return status.State, nil
+	}
+}
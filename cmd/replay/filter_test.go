@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+func Test_filter_match_Function(t *testing.T) {
+	f := &filter{function: "figlet"}
+
+	cases := map[string]bool{
+		"figlet":            true,
+		"figlet.staging-fn": true,
+		"/figlet":           true,
+		"nodeinfo":          false,
+		"figlet-2.openfaas": false,
+	}
+
+	for function, want := range cases {
+		got, _ := f.match(&ftypes.QueueRequest{Function: function})
+		if got != want {
+			t.Errorf("%s want %t, got %t", function, want, got)
+		}
+	}
+}
+
+func Test_filter_match_CallID(t *testing.T) {
+	f := &filter{callIDs: map[string]bool{"abc": true}}
+
+	req := &ftypes.QueueRequest{Function: "figlet", Header: http.Header{}}
+	req.Header.Set("X-Call-Id", "abc")
+
+	if ok, _ := f.match(req); !ok {
+		t.Errorf("want abc to match")
+	}
+
+	req.Header.Set("X-Call-Id", "def")
+
+	if ok, _ := f.match(req); ok {
+		t.Errorf("want def not to match")
+	}
+}
+
+func Test_filter_match_Status(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status/abc":
+			w.Write([]byte(`{"callId":"abc","state":"failed"}`))
+		case "/status/def":
+			w.Write([]byte(`{"callId":"def","state":"succeeded"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	f := &filter{status: lifecycle.Failed, statusOf: makeStatusFunc(server.Client(), server.URL)}
+
+	cases := map[string]bool{
+		"abc": true,
+		"def": false,
+		"ghi": false,
+		"":    false,
+	}
+
+	for callID, want := range cases {
+		req := &ftypes.QueueRequest{Header: http.Header{}}
+		req.Header.Set("X-Call-Id", callID)
+
+		got, err := f.match(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("%q want %t, got %t", callID, want, got)
+		}
+	}
+}
+
+func Test_filter_done(t *testing.T) {
+	until := time.Now()
+	f := &filter{endSequence: 10, until: until}
+
+	cases := []struct {
+		sequence  uint64
+		timestamp time.Time
+		want      bool
+	}{
+		{sequence: 10, timestamp: until.Add(-time.Minute), want: false},
+		{sequence: 11, timestamp: until.Add(-time.Minute), want: true},
+		{sequence: 5, timestamp: until.Add(time.Second), want: true},
+	}
+
+	for _, c := range cases {
+		msg := &stan.Msg{MsgProto: pb.MsgProto{Sequence: c.sequence, Timestamp: c.timestamp.UnixNano()}}
+		if got := f.done(msg); got != c.want {
+			t.Errorf("sequence %d want %t, got %t", c.sequence, c.want, got)
+		}
+	}
+}
+
+func Test_startOption_RequiresStart(t *testing.T) {
+	if _, err := startOption(0, 0, time.Time{}); err == nil {
+		t.Errorf("want error when no start is given")
+	}
+
+	if _, err := startOption(10, 0, time.Time{}); err != nil {
+		t.Errorf("want no error for a sequence, got: %s", err)
+	}
+}
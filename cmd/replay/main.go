@@ -0,0 +1,236 @@
+// Command replay reads requests back from a NATS Streaming channel, from a
+// sequence or time, and re-publishes them to the queue or invokes them via
+// the gateway. It uses a non-durable subscription, so the worker's durable
+// is unaffected.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+func main() {
+	var (
+		natsURL        string
+		clusterID      string
+		channel        string
+		startSeq       uint64
+		endSeq         uint64
+		startTime      string
+		endTime        string
+		since          time.Duration
+		function       string
+		callIDs        string
+		status         string
+		statusURL      string
+		mode           string
+		gatewayURL     string
+		dryRun         bool
+		idleTimeout    time.Duration
+		connectTimeout time.Duration
+	)
+
+	flag.StringVar(&natsURL, "nats-url", "nats://nats:4222", "URL of the NATS Streaming server, or a comma separated list of URLs")
+	flag.StringVar(&clusterID, "cluster", "faas-cluster", "NATS Streaming cluster ID")
+	flag.StringVar(&channel, "channel", "faas-request", "channel to read requests from")
+	flag.Uint64Var(&startSeq, "start-seq", 0, "replay from this sequence")
+	flag.Uint64Var(&endSeq, "end-seq", 0, "replay up to and including this sequence")
+	flag.StringVar(&startTime, "start-time", "", "replay from this time, in RFC3339 format")
+	flag.StringVar(&endTime, "end-time", "", "replay up to this time, in RFC3339 format, defaults to now")
+	flag.DurationVar(&since, "since", 0, "replay requests queued within this duration, i.e. 1h")
+	flag.StringVar(&function, "function", "", "only replay requests for this function, as name or name.namespace")
+	flag.StringVar(&callIDs, "call-id", "", "only replay requests with these X-Call-Id values, comma separated")
+	flag.StringVar(&status, "status", "", "only replay requests in this state, i.e. failed, looked up from -status-url")
+	flag.StringVar(&statusURL, "status-url", "http://queue-worker:8081", "URL of a queue-worker with track_status enabled")
+	flag.StringVar(&mode, "mode", "queue", "queue to re-publish requests, or invoke to call functions via the gateway")
+	flag.StringVar(&gatewayURL, "gateway", "http://gateway:8080", "URL of the gateway for -mode=invoke")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the requests which match without replaying them")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Second*5, "stop once no messages are received for this long")
+	flag.DurationVar(&connectTimeout, "connect-timeout", time.Second*2, "how long to wait for the connection to NATS Streaming")
+	flag.Parse()
+
+	if mode != "queue" && mode != "invoke" {
+		log.Fatalf("-mode must be queue or invoke, got: %s", mode)
+	}
+
+	start, err := parseTime(startTime)
+	if err != nil {
+		log.Fatalf("-start-time: %s", err)
+	}
+
+	startAt, err := startOption(startSeq, since, start)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	until, err := parseTime(endTime)
+	if err != nil {
+		log.Fatalf("-end-time: %s", err)
+	}
+
+	// Requests queued after the replay started are never replayed, this
+	// includes those it re-publishes.
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	client := &http.Client{Timeout: time.Minute}
+
+	f := &filter{
+		function:    function,
+		callIDs:     map[string]bool{},
+		status:      lifecycle.State(status),
+		statusOf:    makeStatusFunc(client, statusURL),
+		endSequence: endSeq,
+		until:       until,
+	}
+
+	for _, id := range strings.Split(callIDs, ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 {
+			f.callIDs[id] = true
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	clientID := nats.NewClientID("faas-replay-", hostname, nats.ClientIDUnique)
+
+	connect := nats.ConnectOptions{ConnectTimeout: connectTimeout}
+
+	conn, err := stan.Connect(clusterID, clientID, connect.StanOptions(natsURL)...)
+	if err != nil {
+		log.Fatalf("Can't connect to %s: %s", natsURL, err)
+	}
+	defer conn.Close()
+
+	msgs := make(chan *stan.Msg)
+	done := make(chan struct{})
+
+	sub, err := conn.Subscribe(channel, func(msg *stan.Msg) {
+		select {
+		case msgs <- msg:
+		case <-done:
+		}
+	}, startAt)
+	if err != nil {
+		log.Fatalf("Couldn't subscribe to %s: %s", channel, err)
+	}
+
+	var scanned, matched, replayed, failed int
+
+	for {
+		var msg *stan.Msg
+
+		select {
+		case msg = <-msgs:
+		case <-time.After(idleTimeout):
+		}
+
+		if msg == nil || f.done(msg) {
+			break
+		}
+
+		scanned++
+
+		req := ftypes.QueueRequest{}
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			log.Printf("[%d] Unmarshal error: %s", msg.Sequence, err)
+			continue
+		}
+
+		ok, err := f.match(&req)
+		if err != nil {
+			log.Printf("[%d] Unable to get status for %s: %s", msg.Sequence, req.Header.Get("X-Call-Id"), err)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		matched++
+
+		queued := time.Unix(0, msg.Timestamp).Format(time.RFC3339)
+		if dryRun {
+			fmt.Printf("[%d] %s %s X-Call-Id: %s\n", msg.Sequence, queued, req.Function, req.Header.Get("X-Call-Id"))
+			continue
+		}
+
+		if mode == "queue" {
+			err = conn.Publish(channel, msg.Data)
+		} else {
+			err = invoke(client, gatewayURL, &req)
+		}
+
+		if err != nil {
+			failed++
+			log.Printf("[%d] Error replaying %s: %s", msg.Sequence, req.Function, err)
+			continue
+		}
+
+		replayed++
+		log.Printf("[%d] Replayed %s queued at %s", msg.Sequence, req.Function, queued)
+	}
+
+	close(done)
+	sub.Unsubscribe()
+
+	log.Printf("Scanned: %d, matched: %d, replayed: %d, failed: %d", scanned, matched, replayed, failed)
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// invoke calls the function via the gateway, waiting for its response.
+func invoke(client *http.Client, gatewayURL string, req *ftypes.QueueRequest) error {
+	u := strings.TrimSuffix(gatewayURL, "/") + "/function/" + strings.Trim(req.Function, "/") + req.Path
+	if len(req.QueryString) > 0 {
+		u += "?" + strings.TrimLeft(req.QueryString, "?")
+	}
+
+	method := req.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+
+	request, err := http.NewRequest(method, u, bytes.NewReader(req.Body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range req.Header {
+		request.Header[k] = v
+	}
+
+	res, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
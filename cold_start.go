@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	DefaultColdStartPollInterval = time.Second
+	DefaultSecretMountPath       = "/var/secrets"
+)
+
+// coldStartWaiter waits for a function which was scaled to zero to have an
+// available replica, so that the response it gave whilst starting isn't
+// reported as its result.
+type coldStartWaiter struct {
+	gatewayURL       string
+	client           *http.Client
+	wait             time.Duration
+	interval         time.Duration
+	defaultNamespace string
+
+	// username and password are sent to the gateway's API when basic_auth
+	// is enabled.
+	username string
+	password string
+}
+
+// newColdStartWaiter returns nil when cold_start_wait is not set, or
+// functions are invoked directly and there is no gateway to ask.
+func newColdStartWaiter(config QueueWorkerConfig, client *http.Client) *coldStartWaiter {
+	if config.ColdStartWait <= 0 || config.DirectFunctions {
+		return nil
+	}
+
+	c := &coldStartWaiter{
+		gatewayURL:       "http://" + config.GatewayAddressURL(),
+		client:           client,
+		wait:             config.ColdStartWait,
+		interval:         config.ColdStartPollInterval,
+		defaultNamespace: config.DefaultNamespace,
+	}
+
+	if config.BasicAuth {
+		username, password, err := readBasicAuth(config.SecretMountPath)
+		if err != nil {
+			log.Printf("Unable to read basic auth credentials, checking readiness without them: %s", err)
+		} else {
+			c.username = username
+			c.password = password
+		}
+	}
+
+	return c
+}
+
+// Wait polls the gateway until the function has an available replica, or
+// returns an error once cold_start_wait has passed.
+func (c *coldStartWaiter) Wait(ctx context.Context, function string) error {
+	name, namespace := splitFunctionName(strings.Trim(function, "/"), c.defaultNamespace)
+
+	ctx, cancel := context.WithTimeout(ctx, c.wait)
+	defer cancel()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		ready, err := c.ready(ctx, name, namespace)
+		if err != nil {
+			return err
+		}
+
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %s", name, c.wait)
+		}
+	}
+}
+
+// ready returns true when the function has an available replica. An error
+// is returned when the function doesn't exist, as it won't become ready.
+func (c *coldStartWaiter) ready(ctx context.Context, name, namespace string) (bool, error) {
+	functionURL := fmt.Sprintf("%s/system/function/%s", c.gatewayURL, url.PathEscape(name))
+	if len(namespace) > 0 {
+		functionURL += "?namespace=" + url.QueryEscape(namespace)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, functionURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if len(c.username) > 0 {
+		request.SetBasicAuth(c.username, c.password)
+	}
+
+	res, err := c.client.Do(request)
+	if err != nil {
+		// The gateway may be restarting too, keep polling until the wait
+		// runs out.
+		return false, nil
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, fmt.Errorf("%s not found", name)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, fmt.Errorf("unable to check %s is ready, status: %d", name, res.StatusCode)
+	default:
+		return false, nil
+	}
+
+	status := ftypes.FunctionStatus{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		return false, fmt.Errorf("unable to decode status of %s: %w", name, err)
+	}
+
+	return status.AvailableReplicas > 0, nil
+}
+
+// coldStartResponse returns true for the statuses the gateway gives whilst
+// a function is scaled to zero or its first replica is starting.
+func coldStartResponse(res *http.Response, err error) bool {
+	if err != nil {
+		return false
+	}
+
+	return res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusNotFound
+}
+
+// readBasicAuth reads the gateway's credentials from the basic-auth-user and
+// basic-auth-password secrets.
+func readBasicAuth(mountPath string) (string, string, error) {
+	username, err := os.ReadFile(path.Join(mountPath, "basic-auth-user"))
+	if err != nil {
+		return "", "", err
+	}
+
+	password, err := os.ReadFile(path.Join(mountPath, "basic-auth-password"))
+	if err != nil {
+		return "", "", err
+	}
+
+	return strings.TrimSpace(string(username)), strings.TrimSpace(string(password)), nil
+}
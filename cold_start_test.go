@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// fakeGateway serves a function which is scaled to zero until it has been
+// polled ready times.
+func fakeGateway(t *testing.T, ready int32, calls, polls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/system/function/figlet":
+			if r.URL.Query().Get("namespace") != "openfaas-fn" {
+				t.Errorf("want namespace openfaas-fn, got %q", r.URL.Query().Get("namespace"))
+			}
+
+			status := ftypes.FunctionStatus{Name: "figlet"}
+			if atomic.AddInt32(polls, 1) >= ready {
+				status.AvailableReplicas = 1
+			}
+
+			json.NewEncoder(w).Encode(status)
+		case strings.HasPrefix(r.URL.Path, "/system/function/"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			atomic.AddInt32(calls, 1)
+
+			if atomic.LoadInt32(polls) < ready {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+}
+
+func testColdStartWaiter(gateway *httptest.Server, wait time.Duration) *coldStartWaiter {
+	return &coldStartWaiter{
+		gatewayURL:       gateway.URL,
+		client:           gateway.Client(),
+		wait:             wait,
+		interval:         time.Millisecond,
+		defaultNamespace: "openfaas-fn",
+	}
+}
+
+func Test_worker_invoke_WaitsForColdStart(t *testing.T) {
+	var calls, polls int32
+	gateway := fakeGateway(t, 3, &calls, &polls)
+	defer gateway.Close()
+
+	w := newWorker(QueueWorkerConfig{}, gateway.Client(), nil)
+
+	req := &ftypes.QueueRequest{Function: "figlet", Body: []byte("hello")}
+	request, _ := http.NewRequest(http.MethodPost, gateway.URL+"/function/figlet", bytes.NewReader(req.Body))
+
+	res, err := w.invoke(context.Background(), 1, request, req, FunctionConfig{}, testColdStartWaiter(gateway, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("want 200 after 2 calls, got %d after %d", res.StatusCode, calls)
+	}
+
+	if polls != 3 {
+		t.Errorf("want 3 polls until ready, got %d", polls)
+	}
+}
+
+func Test_worker_invoke_GivesUpWaitingForColdStart(t *testing.T) {
+	var calls, polls int32
+	gateway := fakeGateway(t, 1000000, &calls, &polls)
+	defer gateway.Close()
+
+	w := newWorker(QueueWorkerConfig{}, gateway.Client(), nil)
+
+	req := &ftypes.QueueRequest{Function: "figlet"}
+	request, _ := http.NewRequest(http.MethodPost, gateway.URL+"/function/figlet", nil)
+
+	res, err := w.invoke(context.Background(), 1, request, req, FunctionConfig{}, testColdStartWaiter(gateway, time.Millisecond*20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+		t.Errorf("want the original 503 after 1 call, got %d after %d", res.StatusCode, calls)
+	}
+}
+
+func Test_coldStartWaiter_WaitFunctionNotFound(t *testing.T) {
+	var calls, polls int32
+	gateway := fakeGateway(t, 1, &calls, &polls)
+	defer gateway.Close()
+
+	started := time.Now()
+	err := testColdStartWaiter(gateway, time.Second).Wait(context.Background(), "missing.openfaas-fn")
+	if err == nil {
+		t.Fatalf("want an error for a function which doesn't exist")
+	}
+
+	if time.Since(started) > time.Millisecond*500 {
+		t.Errorf("want the wait to end when the function isn't found, took %s", time.Since(started))
+	}
+}
+
+func Test_newColdStartWaiter(t *testing.T) {
+	if c := newColdStartWaiter(QueueWorkerConfig{}, http.DefaultClient); c != nil {
+		t.Errorf("want nil without cold_start_wait")
+	}
+
+	if c := newColdStartWaiter(QueueWorkerConfig{ColdStartWait: time.Minute, DirectFunctions: true}, http.DefaultClient); c != nil {
+		t.Errorf("want nil when invoking functions directly")
+	}
+
+	if c := newColdStartWaiter(QueueWorkerConfig{ColdStartWait: time.Minute}, http.DefaultClient); c == nil {
+		t.Errorf("want a waiter with cold_start_wait")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// concurrencyBackoff is the factor the limit is multiplied by when the
+	// gateway or function is overloaded.
+	concurrencyBackoff = 0.75
+
+	// concurrencyDecreaseInterval stops a burst of failures from the same
+	// overload reducing the limit more than once.
+	concurrencyDecreaseInterval = time.Second
+)
+
+// AdaptiveConcurrencyConfig controls the adaptive concurrency limit.
+type AdaptiveConcurrencyConfig struct {
+	// Enabled adjusts the number of concurrent invocations between
+	// MinInflight and max_inflight.
+	Enabled bool
+
+	// MinInflight is the lowest the limit is reduced to.
+	MinInflight int
+
+	// LatencyTarget reduces the limit when an invocation takes longer,
+	// zero means latency is ignored.
+	LatencyTarget time.Duration
+}
+
+// adaptiveLimiter adjusts the concurrency limit with AIMD, additive increase
+// and multiplicative decrease. Each successful invocation raises the limit by
+// 1/limit, so by one for every limit invocations, and each overload signal
+// reduces it by concurrencyBackoff.
+type adaptiveLimiter struct {
+	lock         sync.Mutex
+	min          int
+	max          int
+	target       time.Duration
+	limit        float64
+	lastDecrease time.Time
+
+	// onChange is called with the new limit whenever it changes, without
+	// the lock held as it takes the queue's locks. notifyLock orders the
+	// calls, and applied is the limit it was last called with.
+	onChange   func(limit int)
+	notifyLock sync.Mutex
+	applied    int
+}
+
+func newAdaptiveLimiter(config AdaptiveConcurrencyConfig, max int, onChange func(int)) *adaptiveLimiter {
+	l := &adaptiveLimiter{onChange: onChange}
+	l.Configure(config, max)
+
+	return l
+}
+
+// Configure applies new bounds, keeping the current limit within them.
+func (l *adaptiveLimiter) Configure(config AdaptiveConcurrencyConfig, max int) {
+	defer l.notify()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.max = max
+	if l.max < 1 {
+		l.max = 1
+	}
+
+	l.min = config.MinInflight
+	if l.min < 1 {
+		l.min = 1
+	}
+
+	if l.min > l.max {
+		l.min = l.max
+	}
+
+	l.target = config.LatencyTarget
+
+	previous := l.Limit()
+
+	// A new limiter starts at the minimum and grows as invocations succeed.
+	if l.limit == 0 {
+		l.limit = float64(l.min)
+		previous = 0
+	}
+
+	l.limit = math.Max(float64(l.min), math.Min(float64(l.max), l.limit))
+
+	l.changed(previous)
+}
+
+// Limit returns the number of invocations which can run concurrently.
+func (l *adaptiveLimiter) Limit() int {
+	return int(l.limit)
+}
+
+// Observe adjusts the limit for the outcome of an invocation.
+func (l *adaptiveLimiter) Observe(latency time.Duration, statusCode int, err error, now time.Time) {
+	defer l.notify()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	previous := l.Limit()
+
+	if overloaded(latency, l.target, statusCode, err) {
+		if now.Sub(l.lastDecrease) < concurrencyDecreaseInterval {
+			return
+		}
+
+		l.lastDecrease = now
+		l.limit = math.Max(float64(l.min), l.limit*concurrencyBackoff)
+	} else {
+		l.limit = math.Min(float64(l.max), l.limit+1/l.limit)
+	}
+
+	l.changed(previous)
+}
+
+func (l *adaptiveLimiter) changed(previous int) {
+	limit := l.Limit()
+	if limit == previous {
+		return
+	}
+
+	log.Printf("Concurrency limit changed from %d to %d", previous, limit)
+	concurrencyLimit.Set(float64(limit))
+}
+
+// notify calls onChange with the latest limit, once the lock is released.
+func (l *adaptiveLimiter) notify() {
+	if l.onChange == nil {
+		return
+	}
+
+	l.notifyLock.Lock()
+	defer l.notifyLock.Unlock()
+
+	l.lock.Lock()
+	limit := l.Limit()
+	l.lock.Unlock()
+
+	if limit == l.applied {
+		return
+	}
+
+	l.applied = limit
+	l.onChange(limit)
+}
+
+// overloaded returns true when an invocation shows that the gateway or the
+// function is overloaded.
+func overloaded(latency, target time.Duration, statusCode int, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+		return true
+	}
+
+	return target > 0 && latency > target
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_adaptiveLimiter_StartsAtMin(t *testing.T) {
+	changes := []int{}
+	l := newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 2}, 10, func(limit int) {
+		changes = append(changes, limit)
+	})
+
+	if l.Limit() != 2 || len(changes) != 1 || changes[0] != 2 {
+		t.Errorf("want limit 2 applied on start, got %d with changes %v", l.Limit(), changes)
+	}
+}
+
+func Test_adaptiveLimiter_OnChangeWithoutLock(t *testing.T) {
+	var l *adaptiveLimiter
+	held := []bool{}
+
+	l = newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 1}, 10, func(limit int) {
+		if l == nil {
+			return
+		}
+
+		locked := l.lock.TryLock()
+		if locked {
+			l.lock.Unlock()
+		}
+		held = append(held, !locked)
+	})
+
+	l.Observe(0, http.StatusServiceUnavailable, nil, time.Now())
+	l.Observe(0, http.StatusOK, nil, time.Now())
+	l.Observe(0, http.StatusOK, nil, time.Now())
+
+	if len(held) == 0 {
+		t.Fatal("want onChange called as the limit grew")
+	}
+
+	for _, h := range held {
+		if h {
+			t.Fatal("want onChange called once the limiter's lock is released")
+		}
+	}
+}
+
+func Test_adaptiveLimiter_AdditiveIncrease(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 1}, 4, nil)
+	now := time.Now()
+
+	// The limit grows by 1/limit: 1, 2, 2.5, 2.9, 3.24, 3.55, 3.83, 4.09
+	want := []int{2, 2, 2, 3, 3, 3, 4}
+	for i, limit := range want {
+		l.Observe(time.Millisecond, http.StatusOK, nil, now)
+
+		if l.Limit() != limit {
+			t.Errorf("success %d want limit %d, got %d", i+1, limit, l.Limit())
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		l.Observe(time.Millisecond, http.StatusOK, nil, now)
+	}
+
+	if l.Limit() != 4 {
+		t.Errorf("want limit capped at max of 4, got %d", l.Limit())
+	}
+}
+
+func Test_adaptiveLimiter_MultiplicativeDecrease(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 2}, 16, nil)
+	l.limit = 16
+	now := time.Now()
+
+	l.Observe(time.Millisecond, http.StatusTooManyRequests, nil, now)
+	if l.Limit() != 12 {
+		t.Errorf("want limit 12 after a 429, got %d", l.Limit())
+	}
+
+	l.Observe(time.Millisecond, http.StatusServiceUnavailable, nil, now.Add(time.Millisecond))
+	if l.Limit() != 12 {
+		t.Errorf("want a single decrease within the interval, got %d", l.Limit())
+	}
+
+	l.Observe(time.Millisecond, 0, errors.New("connection refused"), now.Add(time.Second*2))
+	if l.Limit() != 9 {
+		t.Errorf("want limit 9 after a connection error, got %d", l.Limit())
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Observe(time.Millisecond, http.StatusServiceUnavailable, nil, now.Add(time.Duration(3+i)*time.Second))
+	}
+
+	if l.Limit() != 2 {
+		t.Errorf("want limit floored at min of 2, got %d", l.Limit())
+	}
+}
+
+func Test_adaptiveLimiter_LatencyTarget(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 1, LatencyTarget: time.Second}, 8, nil)
+	l.limit = 8
+
+	l.Observe(time.Second*2, http.StatusOK, nil, time.Now())
+
+	if l.Limit() != 6 {
+		t.Errorf("want limit 6 after a slow invocation, got %d", l.Limit())
+	}
+}
+
+func Test_adaptiveLimiter_Configure(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveConcurrencyConfig{MinInflight: 1}, 10, nil)
+	l.limit = 10
+
+	l.Configure(AdaptiveConcurrencyConfig{MinInflight: 1}, 5)
+
+	if l.Limit() != 5 {
+		t.Errorf("want limit lowered to the new max of 5, got %d", l.Limit())
+	}
+}
+
+func Test_NATSQueue_workerCount(t *testing.T) {
+	q := &NATSQueue{maxInFlight: 10}
+
+	if got := q.workerCount(); got != 10 {
+		t.Errorf("want maxInFlight of 10 without a limit, got %d", got)
+	}
+
+	q.workerLimit = 4
+	if got := q.workerCount(); got != 4 {
+		t.Errorf("want limit of 4, got %d", got)
+	}
+
+	q.workerLimit = 20
+	if got := q.workerCount(); got != 10 {
+		t.Errorf("want maxInFlight as the ceiling, got %d", got)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configPollInterval is how often the config_file is checked for changes.
+const configPollInterval = time.Second * 10
+
+// lookupFunc finds a config value by its env variable name.
+type lookupFunc func(name string) (string, bool)
+
+// configFile holds the settings read from the config_file.
+type configFile struct {
+	values    map[string]string
+	functions map[string]map[string]string
+
+	lock sync.Mutex
+	used map[string]bool
+}
+
+// configLookup finds config values in env variables first, then in the
+// file given by the config_file env variable, if any.
+func configLookup() (lookupFunc, *configFile, error) {
+	path, exists := os.LookupEnv("config_file")
+	if !exists || len(path) == 0 {
+		return os.LookupEnv, nil, nil
+	}
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return func(name string) (string, bool) {
+		file.lock.Lock()
+		file.used[name] = true
+		file.lock.Unlock()
+
+		if val, exists := os.LookupEnv(name); exists {
+			return val, true
+		}
+
+		val, exists := file.values[name]
+		return val, exists
+	}, file, nil
+}
+
+// unused returns the settings in the file which were never looked up, these
+// are most likely misspelled.
+func (f *configFile) unused() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var names []string
+	for name := range f.values {
+		if !f.used[name] {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// readConfigFile reads a YAML or JSON file, by its extension, or otherwise a
+// file of name=value lines. The settings use the same names as the env
+// variables.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config_file %s: %s", path, err)
+	}
+
+	file := &configFile{
+		values:    map[string]string{},
+		functions: map[string]map[string]string{},
+		used:      map[string]bool{},
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		doc := map[string]interface{}{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse config_file %s: %s", path, err)
+		}
+
+		return file, file.load(path, doc)
+	case ".json":
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse config_file %s: %s", path, err)
+		}
+
+		return file, file.load(path, doc)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("config_file %s line %d: want name=value, got %q", path, n, line)
+		}
+
+		file.values[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	}
+
+	return file, scanner.Err()
+}
+
+// load flattens a YAML or JSON document into the same form as the env
+// variables, lists become comma separated and maps become name=value pairs.
+func (f *configFile) load(path string, doc map[string]interface{}) error {
+	for name, value := range doc {
+		if name != "functions" {
+			f.values[name] = flatten(value)
+			continue
+		}
+
+		functions, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config_file %s: functions must be a map of function names", path)
+		}
+
+		for function, settings := range functions {
+			fields, ok := settings.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("config_file %s: settings for function %s must be a map", path, function)
+			}
+
+			f.functions[function] = map[string]string{}
+			for field, v := range fields {
+				f.functions[function][field] = flatten(v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func flatten(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, flatten(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		pairs := make([]string, 0, len(v))
+		for k, item := range v {
+			pairs = append(pairs, k+"="+flatten(item))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// readFunctions parses the functions section of the config_file.
+func readFunctions(functions map[string]map[string]string, errs *configErrors) map[string]FunctionConfig {
+	configs := map[string]FunctionConfig{}
+
+	for function, fields := range functions {
+		config := FunctionConfig{}
+
+		for field, value := range fields {
+			var err error
+
+			switch field {
+			case "timeout":
+				config.Timeout, err = time.ParseDuration(value)
+				if err == nil && config.Timeout < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+			case "max_inflight":
+				config.MaxInflight, err = strconv.Atoi(value)
+				if err == nil && config.MaxInflight < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+			case "retries":
+				config.Retries, err = strconv.Atoi(value)
+				if err == nil && config.Retries < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+			case "retry_delay":
+				config.RetryDelay, err = time.ParseDuration(value)
+				if err == nil && config.RetryDelay < 0 {
+					err = fmt.Errorf("must not be negative")
+				}
+			case "disable_callbacks":
+				config.DisableCallbacks, err = strconv.ParseBool(value)
+			case "callback_url":
+				config.CallbackURL, err = url.Parse(value)
+				if err == nil && (len(config.CallbackURL.Scheme) == 0 || len(config.CallbackURL.Host) == 0) {
+					err = fmt.Errorf("must be an absolute URL with a scheme and host")
+				}
+			default:
+				errs.add("functions.%s: unknown setting %q", function, field)
+				continue
+			}
+
+			if err != nil {
+				errs.add("functions.%s.%s: invalid value %q: %s", function, field, value, err)
+			}
+		}
+
+		configs[function] = config
+	}
+
+	return configs
+}
+
+// watchConfigFile calls onChange whenever the contents of path change, it
+// polls so that updates to Kubernetes ConfigMaps, which replace a symlink,
+// are seen.
+func watchConfigFile(path string, interval time.Duration, onChange func()) {
+	last, _ := os.ReadFile(path)
+
+	for range time.Tick(interval) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Unable to read config_file %s: %s", path, err)
+			continue
+		}
+
+		if !bytes.Equal(data, last) {
+			last = data
+			onChange()
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.env")
+	os.WriteFile(path, []byte(`
+# Comments and blank lines are ignored
+max_inflight=5
+ack_wait = "45s"
+`), 0600)
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.values["max_inflight"] != "5" || file.values["ack_wait"] != "45s" {
+		t.Errorf("want max_inflight=5 and ack_wait=45s, got %v", file.values)
+	}
+}
+
+func Test_readConfigFile_InvalidLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.env")
+	os.WriteFile(path, []byte("max_inflight\n"), 0600)
+
+	if _, err := readConfigFile(path); err == nil {
+		t.Errorf("want error for a line without a value")
+	}
+}
+
+func Test_ReadConfig_ConfigFileEnvTakesPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.env")
+	os.WriteFile(path, []byte("max_inflight=5\nfaas_gateway_address=file-gateway\nmessage_ttl=1h\n"), 0600)
+
+	os.Setenv("config_file", path)
+	os.Setenv("faas_gateway_address", "env-gateway")
+	os.Unsetenv("max_inflight")
+	defer os.Unsetenv("config_file")
+
+	config, err := ReadConfig{}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MaxInflight != 5 {
+		t.Errorf("MaxInflight want 5 from the config file, got %d", config.MaxInflight)
+	}
+
+	if config.GatewayAddress != "env-gateway" {
+		t.Errorf("GatewayAddress want env-gateway from env, got %s", config.GatewayAddress)
+	}
+
+	if config.MessageTTL != time.Hour {
+		t.Errorf("MessageTTL want 1h from the config file, got %s", config.MessageTTL)
+	}
+
+	if config.ConfigFile != path {
+		t.Errorf("ConfigFile want %s, got %s", path, config.ConfigFile)
+	}
+}
+
+func Test_readConfigFile_YAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.yaml")
+	os.WriteFile(path, []byte(`
+max_inflight: 5
+ack_wait: 45s
+allowed_namespaces:
+  - openfaas-fn
+  - staging-fn
+namespace_timeout:
+  openfaas-fn: 30s
+  staging-fn: 1m
+functions:
+  figlet:
+    timeout: 10s
+    retries: 3
+`), 0600)
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"max_inflight":       "5",
+		"ack_wait":           "45s",
+		"allowed_namespaces": "openfaas-fn,staging-fn",
+		"namespace_timeout":  "openfaas-fn=30s,staging-fn=1m",
+	}
+
+	for name, value := range want {
+		if file.values[name] != value {
+			t.Errorf("%s want %q, got %q", name, value, file.values[name])
+		}
+	}
+
+	if file.functions["figlet"]["timeout"] != "10s" || file.functions["figlet"]["retries"] != "3" {
+		t.Errorf("want figlet timeout=10s and retries=3, got %v", file.functions["figlet"])
+	}
+}
+
+func Test_readConfigFile_JSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.json")
+	os.WriteFile(path, []byte(`{
+	"max_inflight": 5,
+	"stream_response": true,
+	"functions": {"figlet.openfaas-fn": {"max_inflight": 2}}
+}`), 0600)
+
+	file, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.values["max_inflight"] != "5" || file.values["stream_response"] != "true" {
+		t.Errorf("want max_inflight=5 and stream_response=true, got %v", file.values)
+	}
+
+	if file.functions["figlet.openfaas-fn"]["max_inflight"] != "2" {
+		t.Errorf("want figlet.openfaas-fn max_inflight=2, got %v", file.functions)
+	}
+}
+
+func Test_readConfigFile_InvalidFunctions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.yaml")
+	os.WriteFile(path, []byte("functions:\n  - figlet\n"), 0600)
+
+	if _, err := readConfigFile(path); err == nil {
+		t.Errorf("want error for functions given as a list")
+	}
+}
+
+func Test_readFunctions_RejectsInvalidValues(t *testing.T) {
+	errs := &configErrors{}
+	readFunctions(map[string]map[string]string{
+		"figlet": {
+			"max_inflight": "-1",
+			"retries":      "-2",
+			"retry_delay":  "-1s",
+			"callback_url": "/results",
+		},
+		"nodeinfo": {
+			"callback_url": "http://receiver:8080/results",
+			"max_inflight": "0",
+		},
+	}, errs)
+
+	err := errs.err()
+	if err == nil {
+		t.Fatal("want errors for figlet's settings")
+	}
+
+	for _, want := range []string{
+		`functions.figlet.max_inflight: invalid value "-1"`,
+		`functions.figlet.retries: invalid value "-2"`,
+		`functions.figlet.retry_delay: invalid value "-1s"`,
+		`functions.figlet.callback_url: invalid value "/results"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain %q, got:\n%s", want, err.Error())
+		}
+	}
+
+	if strings.Contains(err.Error(), "nodeinfo") {
+		t.Errorf("want nodeinfo's settings accepted, got:\n%s", err.Error())
+	}
+}
+
+func Test_ReadConfig_ConfigFileReportsAllErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "worker.yaml")
+	os.WriteFile(path, []byte(`
+max_inflght: 5
+ack_wait: soon
+result_ttl: 0s
+functions:
+  figlet:
+    timeout: 10s
+    retry: 3
+    retries: many
+`), 0600)
+
+	os.Setenv("config_file", path)
+	defer os.Unsetenv("config_file")
+
+	config, err := ReadConfig{}.Read()
+	if err == nil {
+		t.Fatalf("want error for an invalid config file")
+	}
+
+	for _, want := range []string{
+		`unknown setting "max_inflght"`,
+		"parse ack_wait soon",
+		"result_ttl must be greater than zero",
+		`functions.figlet: unknown setting "retry"`,
+		`functions.figlet.retries: invalid value "many"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error to contain %q, got:\n%s", want, err)
+		}
+	}
+
+	if config.AckWait != time.Second*30 {
+		t.Errorf("AckWait want the default of 30s, got %s", config.AckWait)
+	}
+
+	if config.Functions["figlet"].Timeout != time.Second*10 {
+		t.Errorf("figlet Timeout want 10s, got %s", config.Functions["figlet"].Timeout)
+	}
+}
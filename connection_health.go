@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+// connectionState reports the state of the connection to NATS Streaming.
+type connectionState interface {
+	State() nats.State
+}
+
+// healthState is returned from the health endpoint.
+type healthState struct {
+	Connection nats.State `json:"connection"`
+}
+
+// makeHealthHandler reports whether the worker is connected to NATS
+// Streaming, with a 503 whilst it isn't.
+func makeHealthHandler(queue connectionState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := queue.State()
+
+		w.Header().Set("Content-Type", "application/json")
+		if state != nats.StateConnected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		writeJSON(w, healthState{Connection: state})
+	}
+}
+
+// observeConnection records the connection's events in metrics.
+func observeConnection(event nats.Event) {
+	natsConnectionEventsTotal.WithLabelValues(string(event.Type)).Inc()
+
+	if event.State == nats.StateConnected {
+		natsConnected.Set(1)
+	} else {
+		natsConnected.Set(0)
+	}
+
+	if event.Type == nats.EventSubscriptionLost {
+		log.Printf("Subscription to %s lost: %v\n", event.Subject, event.Err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+func Test_makeHealthHandler(t *testing.T) {
+	cases := []struct {
+		state nats.State
+		code  int
+	}{
+		{nats.StateConnected, http.StatusOK},
+		{nats.StateDisconnected, http.StatusServiceUnavailable},
+		{nats.StateReconnecting, http.StatusServiceUnavailable},
+		{nats.StateFailed, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		events := nats.NewEvents()
+		events.Emit(nats.Event{Type: nats.EventConnected, State: c.state})
+
+		queue := &NATSQueue{events: events}
+
+		rr := httptest.NewRecorder()
+		makeHealthHandler(queue)(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+		if rr.Code != c.code {
+			t.Errorf("%s: want status %d, got %d", c.state, c.code, rr.Code)
+		}
+
+		health := healthState{}
+		if err := json.NewDecoder(rr.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+
+		if health.Connection != c.state {
+			t.Errorf("want connection %s, got %s", c.state, health.Connection)
+		}
+	}
+}
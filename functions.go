@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// FunctionConfig holds the settings applied to a single function, these are
+// given in the functions section of the config_file.
+type FunctionConfig struct {
+	// Timeout for invoking the function, overrides the namespace's timeout.
+	Timeout time.Duration
+
+	// MaxInflight limits the concurrent invocations of the function, zero
+	// means it is only bounded by its namespace and max_inflight.
+	MaxInflight int
+
+	// Retries is the number of times an invocation is retried when the
+	// function can't be reached, or returns 429, 502, 503 or 504.
+	Retries int
+
+	// RetryDelay is how long to wait between retries.
+	RetryDelay time.Duration
+
+	// DisableCallbacks stops results being posted to callback URLs.
+	DisableCallbacks bool
+
+	// CallbackURL receives the result when the request doesn't give a
+	// callback of its own.
+	CallbackURL *url.URL
+}
+
+// functionPolicy finds the settings for a function and limits its
+// concurrency.
+type functionPolicy struct {
+	settings map[string]FunctionConfig
+	slots    map[string]*semaphore
+}
+
+func newFunctionPolicy(config QueueWorkerConfig) *functionPolicy {
+	p := &functionPolicy{
+		settings: map[string]FunctionConfig{},
+		slots:    map[string]*semaphore{},
+	}
+
+	for function, settings := range config.Functions {
+		p.settings[function] = settings
+
+		if settings.MaxInflight > 0 {
+			p.slots[function] = newSemaphore(settings.MaxInflight)
+		}
+	}
+
+	return p
+}
+
+// Lookup returns the key and settings for a function, settings given for
+// name.namespace take precedence over those given for name, which apply in
+// every namespace. The key is empty when there are no settings.
+func (p *functionPolicy) Lookup(name, namespace string) (string, FunctionConfig) {
+	if settings, ok := p.settings[name+"."+namespace]; ok {
+		return name + "." + namespace, settings
+	}
+
+	if settings, ok := p.settings[name]; ok {
+		return name, settings
+	}
+
+	return "", FunctionConfig{}
+}
+
+// Acquire waits up to wait for the function to have capacity for another
+// invocation, ok is false when it didn't. The returned func must be called
+// once the invocation has completed.
+func (p *functionPolicy) Acquire(key string, wait time.Duration) (release func(), ok bool) {
+	return tryAcquireSlot(p.slots, key, wait)
+}
+
+// semaphore limits the concurrent invocations of a namespace or function.
+// Its limit can be changed whilst slots are held, so a reload can carry the
+// slots in use over to the new settings.
+type semaphore struct {
+	lock     sync.Mutex
+	limit    int
+	held     int
+	released chan struct{}
+}
+
+func newSemaphore(limit int) *semaphore {
+	return &semaphore{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// tryAcquire takes a slot, waiting up to wait for one to be released. It
+// returns false when none was.
+func (s *semaphore) tryAcquire(wait time.Duration) bool {
+	var timer *time.Timer
+
+	for {
+		s.lock.Lock()
+		if s.held < s.limit {
+			s.held++
+			s.lock.Unlock()
+			return true
+		}
+		released := s.released
+		s.lock.Unlock()
+
+		if timer == nil {
+			if wait <= 0 {
+				return false
+			}
+
+			timer = time.NewTimer(wait)
+			defer timer.Stop()
+		}
+
+		select {
+		case <-released:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// release returns a slot taken by tryAcquire.
+func (s *semaphore) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.held--
+	s.wake()
+}
+
+// resize changes the limit, slots already held still count towards it.
+func (s *semaphore) resize(limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.limit = limit
+	s.wake()
+}
+
+// wake lets callers waiting in tryAcquire check for a free slot again, the
+// lock must be held.
+func (s *semaphore) wake() {
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// tryAcquireSlot takes a slot from the semaphore for key, waiting up to wait
+// for one to be released. ok is false when none was, keys without a
+// semaphore are not limited.
+func tryAcquireSlot(slots map[string]*semaphore, key string, wait time.Duration) (release func(), ok bool) {
+	s, found := slots[key]
+	if !found {
+		return func() {}, true
+	}
+
+	if !s.tryAcquire(wait) {
+		return nil, false
+	}
+
+	return s.release, true
+}
+
+// carrySlots replaces each semaphore in slots with the one previous held for
+// the same key, resized to the new limit. Invocations started before a reload
+// release the semaphore they acquired, so they must keep counting towards the
+// limit rather than a new semaphore allowing max_inflight more alongside them.
+func carrySlots(slots, previous map[string]*semaphore) {
+	for key, s := range slots {
+		if old, ok := previous[key]; ok {
+			old.resize(s.limit)
+			slots[key] = old
+		}
+	}
+}
+
+// retryable returns true when an invocation failed in a way which a later
+// attempt may not, the function could not be reached or was overloaded.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
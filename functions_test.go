@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+func Test_functionPolicy_Lookup(t *testing.T) {
+	p := newFunctionPolicy(QueueWorkerConfig{
+		Functions: map[string]FunctionConfig{
+			"figlet":            {Retries: 1},
+			"figlet.staging-fn": {Retries: 2},
+		},
+	})
+
+	if key, settings := p.Lookup("figlet", "staging-fn"); key != "figlet.staging-fn" || settings.Retries != 2 {
+		t.Errorf("want figlet.staging-fn with 2 retries, got %s with %d", key, settings.Retries)
+	}
+
+	if key, settings := p.Lookup("figlet", "openfaas-fn"); key != "figlet" || settings.Retries != 1 {
+		t.Errorf("want figlet with 1 retry, got %s with %d", key, settings.Retries)
+	}
+
+	if key, _ := p.Lookup("nodeinfo", "openfaas-fn"); key != "" {
+		t.Errorf("want no settings for nodeinfo, got %s", key)
+	}
+}
+
+func Test_functionPolicy_AcquireGivesUpWhenBusy(t *testing.T) {
+	p := newFunctionPolicy(QueueWorkerConfig{
+		Functions: map[string]FunctionConfig{
+			"figlet": {MaxInflight: 1},
+		},
+	})
+
+	release, ok := p.Acquire("figlet", 0)
+	if !ok {
+		t.Fatal("want the first Acquire to succeed")
+	}
+
+	if _, ok := p.Acquire("figlet", 10*time.Millisecond); ok {
+		t.Fatal("want the second Acquire to give up whilst the function is busy")
+	}
+
+	if _, ok := p.Acquire("", 0); !ok {
+		t.Error("want functions without settings to be unlimited")
+	}
+
+	release()
+
+	if _, ok := p.Acquire("figlet", 0); !ok {
+		t.Error("want Acquire to succeed once released")
+	}
+}
+
+func Test_retryable(t *testing.T) {
+	cases := []struct {
+		res  *http.Response
+		err  error
+		want bool
+	}{
+		{res: &http.Response{StatusCode: http.StatusOK}, want: false},
+		{res: &http.Response{StatusCode: http.StatusInternalServerError}, want: false},
+		{res: &http.Response{StatusCode: http.StatusTooManyRequests}, want: true},
+		{res: &http.Response{StatusCode: http.StatusBadGateway}, want: true},
+		{err: errors.New("connection refused"), want: true},
+		{err: context.DeadlineExceeded, want: false},
+	}
+
+	for _, c := range cases {
+		if got := retryable(c.res, c.err); got != c.want {
+			t.Errorf("retryable(%v, %v) want %t, got %t", c.res, c.err, c.want, got)
+		}
+	}
+}
+
+func Test_worker_invoke_Retries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	w := newWorker(QueueWorkerConfig{}, server.Client(), nil)
+
+	req := &ftypes.QueueRequest{Function: "figlet", Body: []byte("hello")}
+	request, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(req.Body))
+
+	res, err := w.invoke(context.Background(), 1, request, req, FunctionConfig{Retries: 3, RetryDelay: time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("want 200 after 3 calls, got %d after %d", res.StatusCode, calls)
+	}
+}
+
+func Test_worker_invoke_GivesUpAfterRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	w := newWorker(QueueWorkerConfig{}, server.Client(), nil)
+
+	req := &ftypes.QueueRequest{Function: "figlet"}
+	request, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+
+	res, err := w.invoke(context.Background(), 1, request, req, FunctionConfig{Retries: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusBadGateway || calls != 2 {
+		t.Errorf("want 502 after 2 calls, got %d after %d", res.StatusCode, calls)
+	}
+}
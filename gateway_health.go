@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGatewayHealthPath       = "/healthz"
+	DefaultGatewayHealthInterval   = time.Second * 5
+	DefaultGatewayFailureThreshold = 5
+)
+
+// gatewayMonitor pauses consuming from the queue whilst the gateway is
+// unhealthy, so that messages stay in NATS Streaming rather than being
+// invoked and failed. The gateway is unhealthy after failureThreshold
+// consecutive invocations fail to reach it, or when its health endpoint
+// fails, and healthy again once the health endpoint succeeds.
+type gatewayMonitor struct {
+	healthURL        string
+	client           *http.Client
+	interval         time.Duration
+	failureThreshold int
+	queue            pauser
+
+	lock     sync.Mutex
+	healthy  bool
+	failures int
+
+	// paused is true when the monitor wants the queue paused, so that a
+	// pause from the admin API is not undone.
+	paused bool
+
+	// applied is true whilst apply has the queue paused, it may not yet
+	// match paused.
+	applied bool
+
+	// changed wakes apply after paused changes. It holds one wake-up at
+	// most, so that a flapping gateway never blocks whilst the lock is held.
+	changed chan struct{}
+}
+
+func newGatewayMonitor(config QueueWorkerConfig, client *http.Client, queue pauser) *gatewayMonitor {
+	gatewayHealth.Set(1)
+
+	m := &gatewayMonitor{
+		healthURL:        "http://" + config.GatewayAddressURL() + config.GatewayHealthPath,
+		client:           client,
+		interval:         config.GatewayHealthInterval,
+		failureThreshold: config.GatewayFailureThreshold,
+		queue:            queue,
+		healthy:          true,
+		changed:          make(chan struct{}, 1),
+	}
+
+	go m.apply()
+
+	return m
+}
+
+// Healthy returns false whilst the gateway is unhealthy.
+func (m *gatewayMonitor) Healthy() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.healthy
+}
+
+// Observe records whether an invocation reached the gateway.
+func (m *gatewayMonitor) Observe(res *http.Response, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !gatewayFailure(res, err) {
+		m.failures = 0
+		return
+	}
+
+	m.failures++
+
+	if m.healthy && m.failures >= m.failureThreshold {
+		m.setHealthy(false, "%d consecutive invocations failed", m.failures)
+	}
+}
+
+// run probes the gateway's health endpoint until the process exits.
+func (m *gatewayMonitor) run() {
+	for range time.Tick(m.interval) {
+		m.check()
+	}
+}
+
+func (m *gatewayMonitor) check() {
+	err := m.probe()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err != nil && m.healthy {
+		m.setHealthy(false, "health check failed: %s", err)
+	} else if err == nil && !m.healthy {
+		m.failures = 0
+		m.setHealthy(true, "health check succeeded")
+	}
+}
+
+func (m *gatewayMonitor) probe() error {
+	res, err := m.client.Get(m.healthURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// setHealthy pauses or resumes the queue, the lock must be held.
+func (m *gatewayMonitor) setHealthy(healthy bool, format string, a ...interface{}) {
+	m.healthy = healthy
+
+	if healthy {
+		gatewayHealth.Set(1)
+		log.Printf("Gateway is healthy, "+format, a...)
+
+		if m.paused {
+			m.paused = false
+			m.notify()
+		}
+
+		return
+	}
+
+	gatewayHealth.Set(0)
+	log.Printf("Gateway is unhealthy, "+format, a...)
+
+	// Paused by the admin API, rather than by the monitor.
+	if m.queue.isPaused() && !m.applied {
+		return
+	}
+
+	m.paused = true
+	m.notify()
+}
+
+// notify wakes apply, unless it is already due to wake.
+func (m *gatewayMonitor) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// apply pauses or resumes the queue to match the latest decision, changes
+// made whilst it was busy are coalesced. Pausing waits for invocations in
+// progress, which may be waiting on the lock, so it happens here rather than
+// in setHealthy.
+func (m *gatewayMonitor) apply() {
+	for range m.changed {
+		m.lock.Lock()
+		pause := m.paused
+		changed := pause != m.applied
+		m.applied = pause
+		m.lock.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		if !pause {
+			log.Printf("Resuming as the gateway recovered")
+
+			if err := m.queue.resume(); err != nil {
+				log.Printf("Unable to resume after the gateway recovered: %s", err)
+			}
+
+			continue
+		}
+
+		log.Printf("Pausing until %s succeeds", m.healthURL)
+
+		if err := m.queue.pause(); err != nil {
+			log.Printf("Unable to pause whilst the gateway is unhealthy: %s", err)
+		}
+	}
+}
+
+// gatewayFailure returns true when an invocation didn't reach a function
+// because of the gateway: the connection to it failed, or it responded with
+// a 502, 503 or 504 of its own. Responses from a function carry the
+// X-Duration-Seconds header, and timeouts or other errors of a function
+// aren't counted, so that one slow or failing function doesn't pause the
+// worker.
+func gatewayFailure(res *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr)
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return len(res.Header.Get("X-Duration-Seconds")) == 0
+	}
+
+	return false
+}
+
+// notSent returns true when the request couldn't be sent as the connection
+// to the gateway wasn't made, so the function wasn't invoked.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
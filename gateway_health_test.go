@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+// recordingPauser records the order of pauses and resumes.
+type recordingPauser struct {
+	lock    sync.Mutex
+	paused  bool
+	actions chan string
+}
+
+func (p *recordingPauser) pause() error {
+	p.lock.Lock()
+	p.paused = true
+	p.lock.Unlock()
+
+	p.actions <- "pause"
+	return nil
+}
+
+func (p *recordingPauser) resume() error {
+	p.lock.Lock()
+	p.paused = false
+	p.lock.Unlock()
+
+	p.actions <- "resume"
+	return nil
+}
+
+func (p *recordingPauser) isPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.paused
+}
+
+func (p *recordingPauser) next(t *testing.T) string {
+	select {
+	case action := <-p.actions:
+		return action
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for pause or resume")
+	}
+
+	return ""
+}
+
+// gatewayResponse is a response from the gateway itself, functionResponse
+// one which the gateway forwarded from a function.
+func gatewayResponse(statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Header: http.Header{}}
+}
+
+func functionResponse(statusCode int) *http.Response {
+	return &http.Response{StatusCode: statusCode, Header: http.Header{"X-Duration-Seconds": []string{"0.1"}}}
+}
+
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func Test_gatewayMonitor_PausesAfterFailures(t *testing.T) {
+	queue := &recordingPauser{actions: make(chan string, 4)}
+	m := newGatewayMonitor(QueueWorkerConfig{GatewayFailureThreshold: 3}, http.DefaultClient, queue)
+
+	m.Observe(gatewayResponse(http.StatusServiceUnavailable), nil)
+	m.Observe(nil, errConnectionRefused)
+	m.Observe(functionResponse(http.StatusOK), nil)
+	m.Observe(gatewayResponse(http.StatusBadGateway), nil)
+	m.Observe(gatewayResponse(http.StatusServiceUnavailable), nil)
+
+	if !m.Healthy() {
+		t.Fatalf("want healthy as a success reset the failures")
+	}
+
+	m.Observe(functionResponse(http.StatusInternalServerError), nil)
+	if !m.Healthy() {
+		t.Fatalf("want a 500 from a function to reset the failures")
+	}
+
+	m.Observe(gatewayResponse(http.StatusBadGateway), nil)
+	m.Observe(gatewayResponse(http.StatusServiceUnavailable), nil)
+	m.Observe(gatewayResponse(http.StatusGatewayTimeout), nil)
+
+	if m.Healthy() {
+		t.Fatalf("want unhealthy after 3 consecutive failures")
+	}
+
+	if action := queue.next(t); action != "pause" {
+		t.Errorf("want pause, got %s", action)
+	}
+}
+
+func Test_gatewayFailure(t *testing.T) {
+	cases := []struct {
+		name string
+		res  *http.Response
+		err  error
+		want bool
+	}{
+		{"connection refused", nil, errConnectionRefused, true},
+		{"function timeout", nil, context.DeadlineExceeded, false},
+		{"other error", nil, errors.New("stream error"), false},
+		{"gateway 502", gatewayResponse(http.StatusBadGateway), nil, true},
+		{"gateway 504", gatewayResponse(http.StatusGatewayTimeout), nil, true},
+		{"function 503", functionResponse(http.StatusServiceUnavailable), nil, false},
+		{"gateway 500", gatewayResponse(http.StatusInternalServerError), nil, false},
+	}
+
+	for _, c := range cases {
+		if got := gatewayFailure(c.res, c.err); got != c.want {
+			t.Errorf("%s: want %t, got %t", c.name, c.want, got)
+		}
+	}
+}
+
+func Test_gatewayMonitor_ResumesWhenHealthCheckSucceeds(t *testing.T) {
+	healthy := false
+	var lock sync.Mutex
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if r.URL.Path != "/healthz" || !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	queue := &recordingPauser{actions: make(chan string, 4)}
+	m := newGatewayMonitor(QueueWorkerConfig{GatewayHealthPath: "/healthz", GatewayFailureThreshold: 1}, gateway.Client(), queue)
+	m.healthURL = gateway.URL + "/healthz"
+
+	m.check()
+	if m.Healthy() {
+		t.Fatalf("want unhealthy when the health check fails")
+	}
+
+	if action := queue.next(t); action != "pause" {
+		t.Fatalf("want pause, got %s", action)
+	}
+
+	lock.Lock()
+	healthy = true
+	lock.Unlock()
+
+	m.check()
+	if !m.Healthy() {
+		t.Fatalf("want healthy when the health check succeeds")
+	}
+
+	if action := queue.next(t); action != "resume" {
+		t.Errorf("want resume, got %s", action)
+	}
+}
+
+func Test_gatewayMonitor_KeepsAdminPause(t *testing.T) {
+	queue := &recordingPauser{actions: make(chan string, 4), paused: true}
+	m := newGatewayMonitor(QueueWorkerConfig{GatewayFailureThreshold: 1}, http.DefaultClient, queue)
+
+	m.Observe(gatewayResponse(http.StatusBadGateway), nil)
+
+	m.lock.Lock()
+	m.setHealthy(true, "test")
+	m.lock.Unlock()
+
+	select {
+	case action := <-queue.actions:
+		t.Errorf("want the queue left paused by the admin API, got %s", action)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// blockingPauser blocks in pause until released, as pausing waits for
+// invocations in progress.
+type blockingPauser struct {
+	recordingPauser
+	release chan struct{}
+}
+
+func (p *blockingPauser) pause() error {
+	p.recordingPauser.pause()
+	<-p.release
+	return nil
+}
+
+func Test_gatewayMonitor_FlappingDoesNotBlock(t *testing.T) {
+	queue := &blockingPauser{
+		recordingPauser: recordingPauser{actions: make(chan string, 64)},
+		release:         make(chan struct{}),
+	}
+	m := newGatewayMonitor(QueueWorkerConfig{GatewayFailureThreshold: 1}, http.DefaultClient, queue)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// Far more changes than could be queued whilst pause blocks.
+		for i := 0; i < 50; i++ {
+			m.Observe(gatewayResponse(http.StatusBadGateway), nil)
+
+			m.lock.Lock()
+			m.failures = 0
+			m.setHealthy(true, "test")
+			m.lock.Unlock()
+
+			m.Healthy()
+		}
+
+		m.Observe(gatewayResponse(http.StatusBadGateway), nil)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want a flapping gateway not to block whilst pausing")
+	}
+
+	if m.Healthy() {
+		t.Fatal("want unhealthy after the last failure")
+	}
+
+	if action := queue.next(t); action != "pause" {
+		t.Fatalf("want pause, got %s", action)
+	}
+
+	close(queue.release)
+
+	// The changes made whilst pausing are coalesced to the latest, paused.
+	select {
+	case action := <-queue.actions:
+		if action != "resume" {
+			t.Fatalf("want at most a resume and pause, got %s", action)
+		}
+
+		if action := queue.next(t); action != "pause" {
+			t.Fatalf("want the latest decision applied, got %s", action)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newGatewayWorker returns a worker which invokes functions via the gateway
+// at addr, and pauses after a single gateway failure.
+func newGatewayWorker(t *testing.T, addr string, client *http.Client) *worker {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := QueueWorkerConfig{DefaultNamespace: "openfaas-fn", GatewayFailureThreshold: 1}
+	config.GatewayAddress = host
+	config.GatewayPort, _ = strconv.Atoi(port)
+
+	w := newWorker(config, client, nil)
+	w.gateway = newGatewayMonitor(config, client, &recordingPauser{actions: make(chan string, 4)})
+
+	return w
+}
+
+func Test_worker_handle_GatewayFailureAfterSending(t *testing.T) {
+	var invoked int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&invoked, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer gateway.Close()
+
+	w := newGatewayWorker(t, gateway.Listener.Addr().String(), gateway.Client())
+
+	msg := &stan.Msg{MsgProto: pb.MsgProto{Data: []byte(`{"Function":"figlet","Header":{}}`)}}
+	if !w.handle(msg) {
+		t.Error("want the message acked, as the function may have run")
+	}
+
+	if w.gateway.Healthy() || atomic.LoadInt32(&invoked) != 1 {
+		t.Errorf("want the gateway unhealthy after one invocation, invoked %d times", invoked)
+	}
+}
+
+func Test_worker_handle_GatewayFailureBeforeSending(t *testing.T) {
+	gateway := httptest.NewServer(http.NotFoundHandler())
+	addr := gateway.Listener.Addr().String()
+	gateway.Close()
+
+	w := newGatewayWorker(t, addr, http.DefaultClient)
+
+	msg := &stan.Msg{MsgProto: pb.MsgProto{Data: []byte(`{"Function":"figlet","Header":{}}`)}}
+	if w.handle(msg) {
+		t.Error("want the message left for redelivery, as the gateway couldn't be reached")
+	}
+
+	if w.gateway.Healthy() {
+		t.Error("want the gateway unhealthy")
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+var (
+	// ErrTooLarge is returned for a request which is over the size limit.
+	ErrTooLarge = errors.New("request too large")
+
+	// ErrDisconnected is returned whilst there is no connection to NATS
+	// Streaming, or the connection was closed.
+	ErrDisconnected = errors.New("not connected to NATS Streaming")
+
+	// ErrTimeout is returned when NATS Streaming did not acknowledge the
+	// request before the context's deadline or the publish ack wait.
+	ErrTimeout = errors.New("timed out queueing request")
+
+	// ErrMarshal is returned when the request can't be encoded.
+	ErrMarshal = errors.New("unable to marshal request")
+)
+
+// TooLargeError is returned for a request which is over the size limit once
+// encoded, it matches ErrTooLarge with errors.Is. A gateway can return a 413
+// Request Entity Too Large with its message.
+type TooLargeError struct {
+	// Size of the encoded request in bytes.
+	Size int
+
+	// Limit in bytes, the lower of the configured limit and the server's
+	// max payload.
+	Limit int
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("request too large for OpenFaaS CE: %d bytes once encoded, maximum: %d bytes", e.Size, e.Limit)
+}
+
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// publishError wraps an error from NATS Streaming or the context with the
+// matching error above, so that callers can check it with errors.Is.
+func publishError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, stan.ErrTimeout):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case errors.Is(err, stan.ErrConnectionClosed), errors.Is(err, stan.ErrBadConnection):
+		return fmt.Errorf("%w: %w", ErrDisconnected, err)
+	}
+
+	return err
+}
@@ -4,15 +4,17 @@ import (
 	"fmt"
 	"log"
 	"sync"
+
+	"github.com/openfaas/nats-queue-worker/nats"
 )
 
 const sharedQueue = "faas-request"
 
-// CreateNATSQueue ready for asynchronous message processing of paylods of
-// up to a maximum of 256KB in size.
+// CreateNATSQueue ready for asynchronous message processing of requests of
+// up to the config's maximum message size once encoded, 352KB by default.
 func CreateNATSQueue(address string, port int, clusterName, channel string, clientConfig NATSConfig) (*NATSQueue, error) {
 	var err error
-	natsURL := fmt.Sprintf("nats://%s:%d", address, port)
+	natsURL := connectOptions(clientConfig).URL(fmt.Sprintf("nats://%s:%d", address, port))
 	log.Printf("Opening connection to %s\n", natsURL)
 
 	clientID := clientConfig.GetClientID()
@@ -29,7 +31,14 @@ func CreateNATSQueue(address string, port int, clusterName, channel string, clie
 		Topic:          channel,
 		maxReconnect:   clientConfig.GetMaxReconnect(),
 		reconnectDelay: clientConfig.GetReconnectDelay(),
+		MaxMessageSize: maxMessageSize(clientConfig),
+		connectOptions: connectOptions(clientConfig),
 		ncMutex:        &sync.RWMutex{},
+		events:         nats.NewEvents(),
+	}
+
+	for _, handler := range eventHandlers(clientConfig) {
+		queue1.events.Subscribe(handler)
 	}
 
 	err = queue1.connect()
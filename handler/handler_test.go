@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/openfaas/nats-queue-worker/nats"
 )
@@ -38,3 +39,71 @@ func TestCreategetClientIDWhenHostHasUnsupportedCharacters(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_maxMessageSize(t *testing.T) {
+	if got := maxMessageSize(NewDefaultNATSConfig(0, 0)); got != DefaultMaxMessageSize {
+		t.Errorf("want DefaultMaxMessageSize, got %d", got)
+	}
+
+	if got := maxMessageSize(NewNATSConfig(WithMaxMessageSize(1024))); got != 1024 {
+		t.Errorf("want 1024, got %d", got)
+	}
+}
+
+func Test_NewNATSConfig(t *testing.T) {
+	config := NewNATSConfig(
+		WithMaxReconnect(10),
+		WithReconnectDelay(time.Second),
+		WithClientID("gateway-1"),
+		WithServers("nats://nats-a:4222", "nats://nats-b:4222"),
+		WithPingInterval(time.Second*10, 3),
+	)
+
+	if config.GetMaxReconnect() != 10 || config.GetReconnectDelay() != time.Second {
+		t.Errorf("want reconnect settings applied, got %d and %s", config.GetMaxReconnect(), config.GetReconnectDelay())
+	}
+
+	if config.GetClientID() != "gateway-1" {
+		t.Errorf("want client ID gateway-1, got %s", config.GetClientID())
+	}
+
+	connect := connectOptions(config)
+	if len(connect.Servers) != 2 || connect.PingInterval != time.Second*10 || connect.PingMaxOut != 3 {
+		t.Errorf("want connection options applied, got %+v", connect)
+	}
+
+	unique := NewNATSConfig(WithClientIDStrategy(nats.ClientIDUnique))
+	if unique.GetClientID() == NewDefaultNATSConfig(0, 0).GetClientID() || !strings.HasPrefix(unique.GetClientID(), clientIDPrefix) {
+		t.Errorf("want a unique client ID, got %s", unique.GetClientID())
+	}
+}
+
+func Test_NewNATSConfig_ReconnectsByDefault(t *testing.T) {
+	config := NewNATSConfig()
+
+	if config.GetMaxReconnect() != DefaultMaxReconnect || config.GetReconnectDelay() != DefaultReconnectDelay {
+		t.Errorf("want %d attempts %s apart, got %d and %s", DefaultMaxReconnect, DefaultReconnectDelay, config.GetMaxReconnect(), config.GetReconnectDelay())
+	}
+}
+
+func Test_NewNATSConfig_EventHandlers(t *testing.T) {
+	var got []nats.EventType
+	config := NewNATSConfig(WithEventHandler(func(e nats.Event) {
+		got = append(got, e.Type)
+	}))
+
+	if len(eventHandlers(config)) != 1 || len(eventHandlers(NewDefaultNATSConfig(0, 0))) != 0 {
+		t.Fatalf("want the handler from WithEventHandler only")
+	}
+
+	q := &NATSQueue{events: nats.NewEvents()}
+	for _, handler := range eventHandlers(config) {
+		q.events.Subscribe(handler)
+	}
+
+	q.events.Emit(nats.Event{Type: nats.EventConnected, State: nats.StateConnected})
+
+	if len(got) != 1 || got[0] != nats.EventConnected || q.State() != nats.StateConnected {
+		t.Errorf("want the event delivered and the state kept, got %v and %s", got, q.State())
+	}
+}
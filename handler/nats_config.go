@@ -7,23 +7,167 @@ import (
 	"github.com/openfaas/nats-queue-worker/nats"
 )
 
+// DefaultMaxMessageSize is the largest encoded request which can be queued
+// when the NATSConfig doesn't set a limit. It fits a 256,000 byte body, which
+// is 341,336 bytes once base64 encoded, with room for the headers and other
+// fields, as bodies up to that size were accepted before the encoded request
+// was checked.
+const DefaultMaxMessageSize = 352 * 1000
+
+// DefaultMaxReconnect and DefaultReconnectDelay are used by NewNATSConfig
+// unless set, they match the values used by the gateway.
+const (
+	DefaultMaxReconnect   = 60
+	DefaultReconnectDelay = 2 * time.Second
+)
+
 type NATSConfig interface {
 	GetClientID() string
 	GetMaxReconnect() int
 	GetReconnectDelay() time.Duration
 }
 
+// MessageSizeConfig is implemented by a NATSConfig which limits the size of
+// the encoded requests that can be queued, DefaultMaxMessageSize is used
+// otherwise.
+type MessageSizeConfig interface {
+	GetMaxMessageSize() int
+}
+
+// ConnectOptionsConfig is implemented by a NATSConfig which tunes the
+// connection to NATS Streaming, the stan client's defaults are used
+// otherwise.
+type ConnectOptionsConfig interface {
+	GetConnectOptions() nats.ConnectOptions
+}
+
+// EventHandlerConfig is implemented by a NATSConfig which subscribes to the
+// connection's events, before connecting so that none are missed.
+type EventHandlerConfig interface {
+	GetEventHandlers() []nats.EventHandler
+}
+
 type DefaultNATSConfig struct {
 	maxReconnect   int
 	reconnectDelay time.Duration
+	maxMessageSize int
+	clientID       string
+	connect        nats.ConnectOptions
+	eventHandlers  []nats.EventHandler
 }
 
 func NewDefaultNATSConfig(maxReconnect int, reconnectDelay time.Duration) DefaultNATSConfig {
-	return DefaultNATSConfig{maxReconnect, reconnectDelay}
+	return DefaultNATSConfig{maxReconnect: maxReconnect, reconnectDelay: reconnectDelay}
+}
+
+// NATSOption sets a field of the config built by NewNATSConfig.
+type NATSOption func(*DefaultNATSConfig)
+
+// NewNATSConfig builds a config from options, so that new settings can be
+// added without changing the NATSConfig interface. Unset fields keep the
+// defaults of the stan client, apart from reconnecting which makes up to
+// DefaultMaxReconnect attempts starting DefaultReconnectDelay apart.
+func NewNATSConfig(options ...NATSOption) DefaultNATSConfig {
+	c := DefaultNATSConfig{
+		maxReconnect:   DefaultMaxReconnect,
+		reconnectDelay: DefaultReconnectDelay,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+
+	return c
+}
+
+// WithMaxReconnect sets the number of attempts to reconnect.
+func WithMaxReconnect(maxReconnect int) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.maxReconnect = maxReconnect
+	}
+}
+
+// WithReconnectDelay sets the delay between attempts to reconnect.
+func WithReconnectDelay(delay time.Duration) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.reconnectDelay = delay
+	}
+}
+
+// WithClientID sets the client ID, instead of building it from the hostname.
+func WithClientID(clientID string) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.clientID = clientID
+	}
+}
+
+// WithClientIDStrategy builds the client ID from the hostname with strategy,
+// nats.ClientIDUnique lets several publishers on a host connect.
+func WithClientIDStrategy(strategy nats.ClientIDStrategy) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		hostname, _ := os.Hostname()
+		c.clientID = nats.NewClientID(clientIDPrefix, hostname, strategy)
+	}
+}
+
+// WithServers sets the NATS URLs to connect to, instead of the address and
+// port given to CreateNATSQueue.
+func WithServers(servers ...string) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.connect.Servers = servers
+	}
+}
+
+// WithConnectTimeout sets how long to wait for the connection to be made.
+func WithConnectTimeout(timeout time.Duration) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.connect.ConnectTimeout = timeout
+	}
+}
+
+// WithPingInterval sets how often the server is pinged, and the number of
+// pings without a response after which the connection is lost.
+func WithPingInterval(interval time.Duration, maxOut int) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.connect.PingInterval = interval
+		c.connect.PingMaxOut = maxOut
+	}
+}
+
+// WithPubAckWait sets how long to wait for a request to be acknowledged.
+func WithPubAckWait(wait time.Duration) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.connect.PubAckWait = wait
+	}
+}
+
+// WithMaxPubAcksInflight sets the number of requests which the stan client
+// lets wait for an acknowledgement before publishing blocks.
+func WithMaxPubAcksInflight(max int) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.connect.MaxPubAcksInflight = max
+	}
+}
+
+// WithMaxMessageSize limits encoded requests to bytes.
+func WithMaxMessageSize(bytes int) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.maxMessageSize = bytes
+	}
+}
+
+// WithEventHandler subscribes handler to the connection's events.
+func WithEventHandler(handler nats.EventHandler) NATSOption {
+	return func(c *DefaultNATSConfig) {
+		c.eventHandlers = append(c.eventHandlers, handler)
+	}
 }
 
 // GetClientID returns the ClientID assigned to this producer/consumer.
-func (DefaultNATSConfig) GetClientID() string {
+func (c DefaultNATSConfig) GetClientID() string {
+	if len(c.clientID) > 0 {
+		return c.clientID
+	}
+
 	val, _ := os.Hostname()
 	return getClientID(val)
 }
@@ -36,6 +180,54 @@ func (c DefaultNATSConfig) GetReconnectDelay() time.Duration {
 	return c.reconnectDelay
 }
 
+// GetMaxMessageSize returns the largest encoded request which can be queued.
+func (c DefaultNATSConfig) GetMaxMessageSize() int {
+	if c.maxMessageSize > 0 {
+		return c.maxMessageSize
+	}
+
+	return DefaultMaxMessageSize
+}
+
+// GetConnectOptions returns the options for the connection.
+func (c DefaultNATSConfig) GetConnectOptions() nats.ConnectOptions {
+	return c.connect
+}
+
+// GetEventHandlers returns the handlers subscribed to the connection's events.
+func (c DefaultNATSConfig) GetEventHandlers() []nats.EventHandler {
+	return c.eventHandlers
+}
+
+// maxMessageSize returns the limit from config, or DefaultMaxMessageSize.
+func maxMessageSize(config NATSConfig) int {
+	if sized, ok := config.(MessageSizeConfig); ok && sized.GetMaxMessageSize() > 0 {
+		return sized.GetMaxMessageSize()
+	}
+
+	return DefaultMaxMessageSize
+}
+
+// connectOptions returns the options from config, if it has any.
+func connectOptions(config NATSConfig) nats.ConnectOptions {
+	if connect, ok := config.(ConnectOptionsConfig); ok {
+		return connect.GetConnectOptions()
+	}
+
+	return nats.ConnectOptions{}
+}
+
+// eventHandlers returns the handlers from config, if it has any.
+func eventHandlers(config NATSConfig) []nats.EventHandler {
+	if events, ok := config.(EventHandlerConfig); ok {
+		return events.GetEventHandlers()
+	}
+
+	return nil
+}
+
+const clientIDPrefix = "faas-publisher-"
+
 func getClientID(hostname string) string {
-	return "faas-publisher-" + nats.GetClientID(hostname)
+	return nats.NewClientID(clientIDPrefix, hostname, nats.ClientIDHostname)
 }
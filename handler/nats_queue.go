@@ -1,7 +1,9 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -9,14 +11,23 @@ import (
 
 	stan "github.com/nats-io/stan.go"
 	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+	"github.com/openfaas/nats-queue-worker/nats"
 )
 
+// pubMsgOverhead is reserved from the server's max payload for the subject,
+// GUID and client ID which NATS Streaming adds to each message.
+const pubMsgOverhead = 256
+
 // NATSQueue queue for work
 type NATSQueue struct {
 	nc             stan.Conn
 	ncMutex        *sync.RWMutex
+	manager        *nats.Manager
+	events         *nats.Events
 	maxReconnect   int
 	reconnectDelay time.Duration
+	connectOptions nats.ConnectOptions
 
 	// ClientID for NATS Streaming
 	ClientID string
@@ -29,79 +40,380 @@ type NATSQueue struct {
 
 	// Topic to respond to
 	Topic string
+
+	// StatusSubject when set, a lifecycle event is published to this NATS
+	// subject for each request which is queued with an X-Call-Id.
+	StatusSubject string
+
+	// MaxMessageSize is the largest encoded request which can be queued,
+	// DefaultMaxMessageSize is used when zero. The server's max payload
+	// lowers it once connected.
+	MaxMessageSize int
+
+	// serverMaxPayload is learnt from the server when connecting, it is
+	// guarded by ncMutex.
+	serverMaxPayload int64
+
+	// MaxPendingAcks is the number of messages published with QueueAsync
+	// which can be waiting for an acknowledgement, DefaultMaxPendingAcks
+	// is used when zero.
+	MaxPendingAcks int
+
+	// Spool when set keeps requests whilst disconnected, they are
+	// published in order once the connection is back.
+	Spool *Spool
+
+	pending pendingAcks
+
+	// replaying is true whilst the Spool is being published, so that new
+	// requests are spooled behind it, it is guarded by ncMutex.
+	replaying   bool
+	replayMutex sync.Mutex
 }
 
-// Queue request for processing
+// Queue request for processing, it implements ftypes.RequestQueuer and
+// waits for NATS Streaming to acknowledge the request.
 func (q *NATSQueue) Queue(req *ftypes.QueueRequest) error {
-	callId := ""
+	return q.QueueContext(context.Background(), req)
+}
 
-	if v := req.Header.Get("X-Call-Id"); len(v) > 0 {
-		callId = v
+// QueueContext queues the request and waits for NATS Streaming to
+// acknowledge it, or for ctx to be cancelled or reach its deadline. A request
+// which was sent before ctx was done may still be queued. The errors
+// ErrTooLarge, ErrDisconnected, ErrTimeout and ErrMarshal can be checked with
+// errors.Is, a cancelled ctx returns context.Canceled.
+func (q *NATSQueue) QueueContext(ctx context.Context, req *ftypes.QueueRequest) error {
+	ack, err := q.publish(ctx, req, nil)
+	if err != nil {
+		return err
 	}
-	max := 256 * 1000
-	if len(req.Body) > max {
-		return fmt.Errorf("request body too large for OpenFaaS CE (%d bytes), maximum: %d bytes", len(req.Body), 256*1000)
+
+	select {
+	case <-ack.Done():
+		return ack.Err()
+	case <-ctx.Done():
+		return publishError(ctx.Err())
 	}
+}
 
-	log.Printf("[%s] Queueing (%d) bytes for: %s.\n", callId, len(req.Body), req.Function)
+// publish sends the request without waiting for it to be acknowledged,
+// waiting only whilst MaxPendingAcks messages are already pending.
+func (q *NATSQueue) publish(ctx context.Context, req *ftypes.QueueRequest, onAck AckHandler) (*PublishAck, error) {
+	callId := req.Header.Get("X-Call-Id")
 
 	out, err := json.Marshal(req)
 	if err != nil {
-		log.Println(err)
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
 	}
 
+	if err := q.checkSize(out); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, publishError(err)
+	}
+
+	log.Printf("[%s] Queueing (%d) bytes for: %s.\n", callId, len(req.Body), req.Function)
+
+	subject := q.queueName(req)
+
 	q.ncMutex.RLock()
 	nc := q.nc
+	if q.Spool != nil && (nc == nil || q.replaying) {
+		// The read lock is held until the request is spooled, so that a
+		// replay can't finish before it.
+		defer q.ncMutex.RUnlock()
+
+		return q.spool(callId, req.Function, subject, out)
+	}
 	q.ncMutex.RUnlock()
 
-	queueName := q.Topic
+	if nc == nil {
+		return nil, ErrDisconnected
+	}
+
+	if err := q.pending.acquire(ctx, q.MaxPendingAcks); err != nil {
+		return nil, publishError(err)
+	}
+
+	ack := &PublishAck{done: make(chan struct{})}
+
+	guid, err := nc.PublishAsync(subject, out, func(guid string, err error) {
+		ack.err = publishError(err)
+
+		if err != nil {
+			log.Printf("[%s] Message %s for %s was not acknowledged: %s\n", callId, guid, req.Function, err)
+		} else if len(q.StatusSubject) > 0 && len(callId) > 0 {
+			q.publishStatus(nc, callId, req.Function)
+		}
+
+		q.pending.release(ack.err)
+		close(ack.done)
+
+		if onAck != nil {
+			onAck(guid, ack.err)
+		}
+	})
+
+	if err != nil {
+		// The error is returned here, rather than reported by Flush.
+		q.pending.release(nil)
+
+		err = publishError(err)
+		if q.Spool != nil && errors.Is(err, ErrDisconnected) {
+			return q.spool(callId, req.Function, subject, out)
+		}
+
+		return nil, err
+	}
+
+	ack.GUID = guid
+
+	return ack, nil
+}
+
+// spool appends the message to the Spool, returning an acknowledgement which
+// has already completed.
+func (q *NATSQueue) spool(callId, function, subject string, data []byte) (*PublishAck, error) {
+	if err := q.Spool.Append(subject, data); err != nil {
+		log.Printf("[%s] Unable to spool request for: %s, error: %s\n", callId, function, err)
+		return nil, err
+	}
+
+	log.Printf("[%s] Spooled request for: %s whilst disconnected, depth: %d\n", callId, function, q.Spool.Depth())
+
+	ack := &PublishAck{done: make(chan struct{})}
+	close(ack.done)
+
+	return ack, nil
+}
+
+// ReplaySpool publishes the requests in the Spool in order, requests queued
+// meanwhile are spooled behind them. It is called after reconnecting, and
+// can be called after setting Spool to publish requests left from a previous
+// run. It returns once the Spool is empty, or the connection is lost again.
+// New requests are only spooled behind it whilst it runs, so that they are
+// never left in the Spool when it returns an error.
+func (q *NATSQueue) ReplaySpool() error {
+	if q.Spool == nil {
+		return nil
+	}
+
+	q.replayMutex.Lock()
+	defer q.replayMutex.Unlock()
+
+	q.ncMutex.Lock()
+	q.replaying = true
+	q.ncMutex.Unlock()
+
+	defer func() {
+		q.ncMutex.Lock()
+		q.replaying = false
+		q.ncMutex.Unlock()
+	}()
+
+	replayed := 0
+	for {
+		q.ncMutex.RLock()
+		nc := q.nc
+		q.ncMutex.RUnlock()
+
+		if nc == nil {
+			return ErrDisconnected
+		}
+
+		head, entries, err := q.Spool.peek(spoolReplayBatch)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			q.ncMutex.Lock()
+			empty := q.Spool.Depth() == 0
+			if empty {
+				q.replaying = false
+			}
+			q.ncMutex.Unlock()
+
+			if empty {
+				if replayed > 0 {
+					log.Printf("Replayed %d spooled requests\n", replayed)
+				}
+
+				return nil
+			}
+
+			continue
+		}
+
+		sent := 0
+		for _, entry := range entries {
+			if err = nc.Publish(entry.Subject, entry.Data); err != nil {
+				break
+			}
+
+			sent++
+		}
+
+		replayed += sent
+
+		if removeErr := q.Spool.removeBefore(head + uint64(sent)); removeErr != nil {
+			return removeErr
+		}
+
+		if err != nil {
+			log.Printf("Error replaying spool, %d requests left: %s\n", q.Spool.Depth(), err)
+
+			if errors.Is(publishError(err), ErrDisconnected) {
+				return err
+			}
+
+			time.Sleep(spoolRetryDelay)
+		}
+	}
+}
+
+// queueName is the channel the request is published to.
+func (q *NATSQueue) queueName(req *ftypes.QueueRequest) string {
 	if len(req.QueueName) > 0 {
-		queueName = req.QueueName
+		return req.QueueName
 	}
 
-	return nc.Publish(queueName, out)
+	return q.Topic
 }
 
-func (q *NATSQueue) connect() error {
-	log.Printf("Connect: %s\n", q.NATSURL)
+// checkSize returns a TooLargeError when the encoded request is over the
+// limit.
+func (q *NATSQueue) checkSize(out []byte) error {
+	limit := q.maxMessageSize()
+	if len(out) > limit {
+		return &TooLargeError{Size: len(out), Limit: limit}
+	}
 
-	nc, err := stan.Connect(
-		q.ClusterID,
-		q.ClientID,
-		stan.NatsURL(q.NATSURL),
-		stan.SetConnectionLostHandler(func(conn stan.Conn, err error) {
-			log.Printf("Disconnected from %s\n", q.NATSURL)
+	return nil
+}
 
-			q.reconnect()
-		}),
-	)
+// maxMessageSize returns the lower of MaxMessageSize and the server's max
+// payload, less the space needed by NATS Streaming's envelope.
+func (q *NATSQueue) maxMessageSize() int {
+	limit := q.MaxMessageSize
+	if limit <= 0 {
+		limit = DefaultMaxMessageSize
+	}
 
+	q.ncMutex.RLock()
+	serverMax := int(q.serverMaxPayload) - pubMsgOverhead
+	q.ncMutex.RUnlock()
+
+	if serverMax > 0 && serverMax < limit {
+		limit = serverMax
+	}
+
+	return limit
+}
+
+// publishStatus records that a request was queued, failures are logged as
+// the request itself has already been queued.
+func (q *NATSQueue) publishStatus(nc stan.Conn, callId, function string) {
+	event, err := json.Marshal(lifecycle.Event{
+		CallID:    callId,
+		State:     lifecycle.Queued,
+		Function:  function,
+		Timestamp: time.Now(),
+		WorkerID:  q.ClientID,
+	})
 	if err != nil {
-		return err
+		log.Printf("[%s] Unable to marshal status event: %s\n", callId, err)
+		return
+	}
+
+	if err := nc.NatsConn().Publish(q.StatusSubject, event); err != nil {
+		log.Printf("[%s] Error publishing status event: %s\n", callId, err)
 	}
+}
 
+// connect makes the first connection, the manager reconnects when it is lost.
+func (q *NATSQueue) connect() error {
+	q.manager = nats.NewManager(nats.ManagerConfig{
+		ClusterID:    q.ClusterID,
+		ClientID:     q.ClientID,
+		NatsURL:      q.NATSURL,
+		Options:      q.connectOptions,
+		MaxReconnect: q.maxReconnect,
+		Backoff: nats.Backoff{
+			Initial: q.reconnectDelay,
+			Max:     nats.DefaultMaxBackoff,
+			Jitter:  nats.DefaultJitter,
+		},
+		OnConnect:     q.onConnect,
+		OnStateChange: q.onStateChange,
+		Events:        q.events,
+	})
+
+	return q.manager.Connect()
+}
+
+// onConnect makes a new connection available to publish with. Whilst
+// requests are spooled, new ones are spooled behind them until onStateChange
+// has replayed them, so that the order is kept.
+func (q *NATSQueue) onConnect(nc stan.Conn) error {
 	q.ncMutex.Lock()
 	q.nc = nc
+	if natsConn := nc.NatsConn(); natsConn != nil {
+		q.serverMaxPayload = natsConn.MaxPayload()
+	}
+	if q.Spool != nil && q.Spool.Depth() > 0 {
+		q.replaying = true
+	}
 	q.ncMutex.Unlock()
 
 	return nil
 }
 
-func (q *NATSQueue) reconnect() {
-	log.Printf("Reconnect\n")
+// onStateChange stops publishing once the connection is lost, and replays the
+// Spool once it is back.
+func (q *NATSQueue) onStateChange(from, to nats.State) {
+	if to != nats.StateConnected {
+		q.ncMutex.Lock()
+		q.nc = nil
+		q.ncMutex.Unlock()
+		return
+	}
 
-	for i := 0; i < q.maxReconnect; i++ {
-		time.Sleep(time.Duration(i) * q.reconnectDelay)
+	q.ncMutex.RLock()
+	replaying := q.replaying
+	q.ncMutex.RUnlock()
 
-		if err := q.connect(); err == nil {
-			log.Printf("Reconnecting (%d/%d) to %s. OK\n", i+1, q.maxReconnect, q.NATSURL)
+	if from == nats.StateReconnecting || replaying {
+		go func() {
+			if err := q.ReplaySpool(); err != nil {
+				log.Printf("Unable to replay spool: %s\n", err)
+			}
+		}()
+	}
+}
 
-			return
-		}
+// OnEvent calls handler with each of the connection's events from now on,
+// until unsubscribe is called. Use WithEventHandler to see the first
+// connection.
+func (q *NATSQueue) OnEvent(handler nats.EventHandler) (unsubscribe func()) {
+	return q.events.Subscribe(handler)
+}
 
-		log.Printf("Reconnecting (%d/%d) to %s failed\n", i+1, q.maxReconnect, q.NATSURL)
-	}
+// State returns the state of the connection, it is safe to call
+// concurrently.
+func (q *NATSQueue) State() nats.State {
+	return q.events.State()
+}
 
-	log.Printf("Reached reconnection limit (%d) for %s\n", q.maxReconnect, q.NATSURL)
+// Close stops reconnecting and closes the connection, requests waiting for
+// an acknowledgement may not be acknowledged, call Flush first to wait for
+// them.
+func (q *NATSQueue) Close() error {
+	if q.manager == nil {
+		return nil
+	}
 
+	return q.manager.Close()
 }
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// DefaultMaxPendingAcks is the number of messages published with QueueAsync
+// which can be waiting for an acknowledgement when MaxPendingAcks is not set.
+const DefaultMaxPendingAcks = 1024
+
+// AckHandler is called once NATS Streaming has acknowledged a message, or
+// failed to, with the message's GUID.
+type AckHandler func(guid string, err error)
+
+// PublishAck is the result of a message published with QueueAsync, it
+// completes when NATS Streaming acknowledges the message.
+type PublishAck struct {
+	// GUID assigned to the message by NATS Streaming.
+	GUID string
+
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the message has been acknowledged or has failed.
+func (a *PublishAck) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the error from NATS Streaming, it is only valid after Done is
+// closed.
+func (a *PublishAck) Err() error {
+	return a.err
+}
+
+// Wait blocks until the message has been acknowledged, and returns the
+// error if it was not.
+func (a *PublishAck) Wait() error {
+	<-a.done
+	return a.err
+}
+
+// pendingAcks bounds and tracks the messages waiting for an acknowledgement.
+type pendingAcks struct {
+	once  sync.Once
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	lock     sync.Mutex
+	failures int
+	total    int
+	first    error
+}
+
+// acquire blocks whilst max messages are waiting for an acknowledgement, or
+// until ctx is done.
+func (p *pendingAcks) acquire(ctx context.Context, max int) error {
+	p.once.Do(func() {
+		if max < 1 {
+			max = DefaultMaxPendingAcks
+		}
+
+		p.slots = make(chan struct{}, max)
+	})
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.wg.Add(1)
+
+	return nil
+}
+
+func (p *pendingAcks) release(err error) {
+	p.lock.Lock()
+	p.total++
+	if err != nil {
+		p.failures++
+		if p.first == nil {
+			p.first = err
+		}
+	}
+	p.lock.Unlock()
+
+	<-p.slots
+	p.wg.Done()
+}
+
+// flush waits for every pending message, and reports the failures since the
+// previous flush.
+func (p *pendingAcks) flush() error {
+	p.wg.Wait()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	failures, total, first := p.failures, p.total, p.first
+	p.failures, p.total, p.first = 0, 0, nil
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d messages were not acknowledged, first error: %w", failures, total, first)
+	}
+
+	return nil
+}
+
+// QueueAsync publishes the request without waiting for NATS Streaming to
+// acknowledge it, so that bursts aren't limited by a round-trip for each
+// message. At most MaxPendingAcks messages wait for an acknowledgement, after
+// which QueueAsync blocks. onAck, when not nil, is called with the result, as
+// well as the returned PublishAck completing.
+func (q *NATSQueue) QueueAsync(req *ftypes.QueueRequest, onAck AckHandler) (*PublishAck, error) {
+	return q.publish(context.Background(), req, onAck)
+}
+
+// Flush waits for every message published with QueueAsync to be
+// acknowledged, or to fail, and returns an error when any failed since the
+// previous Flush.
+func (q *NATSQueue) Flush() error {
+	return q.pending.flush()
+}
@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	stan "github.com/nats-io/stan.go"
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+// fakeConn holds the acknowledgement handlers of published messages until
+// ack is called.
+type fakeConn struct {
+	lock     sync.Mutex
+	handlers []stan.AckHandler
+	subjects []string
+	guids    int
+
+	// published holds the data sent with Publish.
+	published [][]byte
+}
+
+func (c *fakeConn) Publish(subject string, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.published = append(c.published, data)
+	return nil
+}
+
+func (c *fakeConn) PublishAsync(subject string, data []byte, ah stan.AckHandler) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.guids++
+	c.handlers = append(c.handlers, ah)
+	c.subjects = append(c.subjects, subject)
+
+	return fmt.Sprintf("guid-%d", c.guids), nil
+}
+
+func (c *fakeConn) Subscribe(subject string, cb stan.MsgHandler, opts ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) QueueSubscribe(subject, qgroup string, cb stan.MsgHandler, opts ...stan.SubscriptionOption) (stan.Subscription, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) NatsConn() *nats.Conn {
+	return nil
+}
+
+// ack acknowledges the oldest message which is waiting, with err.
+func (c *fakeConn) ack(err error) {
+	c.lock.Lock()
+	handler := c.handlers[0]
+	c.handlers = c.handlers[1:]
+	guid := fmt.Sprintf("guid-%d", c.guids-len(c.handlers))
+	c.lock.Unlock()
+
+	handler(guid, err)
+}
+
+func (c *fakeConn) waiting() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.handlers)
+}
+
+func newTestQueue(conn stan.Conn, maxPendingAcks int) *NATSQueue {
+	return &NATSQueue{
+		nc:             conn,
+		ncMutex:        &sync.RWMutex{},
+		Topic:          "faas-request",
+		MaxPendingAcks: maxPendingAcks,
+	}
+}
+
+func Test_QueueAsync_CompletesOnAck(t *testing.T) {
+	conn := &fakeConn{}
+	q := newTestQueue(conn, 0)
+
+	var acked string
+	ack, err := q.QueueAsync(&ftypes.QueueRequest{Function: "figlet", QueueName: "slow-queue"}, func(guid string, err error) {
+		acked = guid
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack.GUID != "guid-1" {
+		t.Errorf("want GUID guid-1, got %s", ack.GUID)
+	}
+
+	if conn.subjects[0] != "slow-queue" {
+		t.Errorf("want the request's queue name, got %s", conn.subjects[0])
+	}
+
+	select {
+	case <-ack.Done():
+		t.Fatalf("want the ack pending until NATS Streaming acknowledges it")
+	default:
+	}
+
+	conn.ack(nil)
+
+	if err := ack.Wait(); err != nil {
+		t.Errorf("want no error, got %s", err)
+	}
+
+	if acked != "guid-1" {
+		t.Errorf("want the ack handler called with guid-1, got %q", acked)
+	}
+}
+
+func Test_QueueAsync_BlocksAtMaxPendingAcks(t *testing.T) {
+	conn := &fakeConn{}
+	q := newTestQueue(conn, 2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := q.QueueAsync(&ftypes.QueueRequest{Function: "figlet"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queued := make(chan struct{})
+	go func() {
+		q.QueueAsync(&ftypes.QueueRequest{Function: "figlet"}, nil)
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+		t.Fatalf("want QueueAsync to block with 2 acks pending")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	conn.ack(nil)
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatalf("want QueueAsync to continue once an ack was received")
+	}
+
+	if conn.waiting() != 2 {
+		t.Errorf("want 2 acks pending, got %d", conn.waiting())
+	}
+}
+
+func Test_Flush_ReportsFailures(t *testing.T) {
+	conn := &fakeConn{}
+	q := newTestQueue(conn, 0)
+
+	for i := 0; i < 3; i++ {
+		if _, err := q.QueueAsync(&ftypes.QueueRequest{Function: "figlet"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- q.Flush()
+	}()
+
+	conn.ack(nil)
+	conn.ack(stan.ErrTimeout)
+	conn.ack(nil)
+
+	select {
+	case err := <-flushed:
+		if !errors.Is(err, stan.ErrTimeout) {
+			t.Errorf("want the timeout reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("want Flush to return once every message was acknowledged")
+	}
+
+	if err := q.Flush(); err != nil {
+		t.Errorf("want no error from a second Flush, got %s", err)
+	}
+}
+
+func Test_QueueAsync_BodyTooLarge(t *testing.T) {
+	q := newTestQueue(&fakeConn{}, 0)
+
+	if _, err := q.QueueAsync(&ftypes.QueueRequest{Body: make([]byte, 300*1000)}, nil); err == nil {
+		t.Errorf("want an error for a body over the limit once encoded")
+	}
+}
+
+func Test_QueueContext_WaitsForAck(t *testing.T) {
+	conn := &fakeConn{}
+	q := newTestQueue(conn, 0)
+
+	queued := make(chan error)
+	go func() {
+		queued <- q.QueueContext(context.Background(), &ftypes.QueueRequest{Function: "figlet"})
+	}()
+
+	for conn.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.ack(stan.ErrConnectionClosed)
+
+	if err := <-queued; !errors.Is(err, ErrDisconnected) {
+		t.Errorf("want ErrDisconnected, got %v", err)
+	}
+}
+
+func Test_QueueContext_Deadline(t *testing.T) {
+	q := newTestQueue(&fakeConn{}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := q.QueueContext(ctx, &ftypes.QueueRequest{Function: "figlet"})
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want ErrTimeout, got %v", err)
+	}
+}
+
+func Test_QueueContext_Cancelled(t *testing.T) {
+	conn := &fakeConn{}
+	q := newTestQueue(conn, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := q.QueueContext(ctx, &ftypes.QueueRequest{Function: "figlet"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+
+	if conn.guids != 0 {
+		t.Errorf("want nothing published once cancelled, got %d", conn.guids)
+	}
+}
+
+func Test_QueueContext_Errors(t *testing.T) {
+	disconnected := newTestQueue(nil, 0)
+	if err := disconnected.QueueContext(context.Background(), &ftypes.QueueRequest{}); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("want ErrDisconnected without a connection, got %v", err)
+	}
+
+	q := newTestQueue(&fakeConn{}, 0)
+	if err := q.QueueContext(context.Background(), &ftypes.QueueRequest{Body: make([]byte, 300*1000)}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("want ErrTooLarge, got %v", err)
+	}
+}
+
+func Test_QueueAsync_AcceptsPreviousBodyLimit(t *testing.T) {
+	q := newTestQueue(&fakeConn{}, 0)
+
+	req := &ftypes.QueueRequest{
+		Function: "figlet",
+		Body:     make([]byte, 256*1000),
+		Header:   http.Header{"X-Call-Id": []string{"call-1"}, "Content-Type": []string{"application/octet-stream"}},
+	}
+
+	if _, err := q.QueueAsync(req, nil); err != nil {
+		t.Errorf("want a 256,000 byte body accepted once encoded, got %s", err)
+	}
+}
+
+func Test_QueueContext_ChecksEncodedSize(t *testing.T) {
+	q := newTestQueue(&fakeConn{}, 0)
+
+	// The body is under the limit, but base64 takes it over once encoded.
+	err := q.QueueContext(context.Background(), &ftypes.QueueRequest{Body: make([]byte, 300*1000)})
+
+	var tooLarge *TooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("want TooLargeError, got %v", err)
+	}
+
+	if tooLarge.Size <= 300*1000*4/3 || tooLarge.Limit != DefaultMaxMessageSize {
+		t.Errorf("want the encoded size checked against %d, got %d against %d", DefaultMaxMessageSize, tooLarge.Size, tooLarge.Limit)
+	}
+
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("want the error to match ErrTooLarge")
+	}
+}
+
+func Test_NATSQueue_maxMessageSize(t *testing.T) {
+	q := newTestQueue(&fakeConn{}, 0)
+	q.MaxMessageSize = 2 * 1024 * 1024
+
+	if got := q.maxMessageSize(); got != 2*1024*1024 {
+		t.Errorf("want the configured limit, got %d", got)
+	}
+
+	q.serverMaxPayload = 1024 * 1024
+
+	if got, want := q.maxMessageSize(), 1024*1024-pubMsgOverhead; got != want {
+		t.Errorf("want the server's max payload less the envelope %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpoolOverflow decides what happens to a request which would take the spool
+// over its size limit.
+type SpoolOverflow string
+
+const (
+	// SpoolRejectNew returns ErrSpoolFull for the new request, keeping the
+	// requests already spooled.
+	SpoolRejectNew SpoolOverflow = "reject-new"
+
+	// SpoolDropOldest drops the oldest requests to make room for the new
+	// one.
+	SpoolDropOldest SpoolOverflow = "drop-oldest"
+)
+
+const (
+	// spoolReplayBatch is the number of requests read from the spool at a
+	// time whilst replaying it.
+	spoolReplayBatch = 100
+
+	// spoolRetryDelay is waited before publishing a spooled request again.
+	spoolRetryDelay = time.Second
+)
+
+// ErrSpoolFull is returned when a request can't be spooled because the spool
+// is at its size limit with SpoolRejectNew.
+var ErrSpoolFull = errors.New("spool is full")
+
+// spoolEntry is a line in the spool's file.
+type spoolEntry struct {
+	Subject string `json:"subject"`
+	Data    []byte `json:"data"`
+}
+
+// Spool is a bounded append log on disk, it keeps requests whilst there is no
+// connection to NATS Streaming so that they can be published in order once it
+// is back. Spooled requests are kept across restarts.
+type Spool struct {
+	path     string
+	maxBytes int64
+	overflow SpoolOverflow
+
+	lock sync.Mutex
+	file *os.File
+
+	// sizes holds the size of each entry in the file, oldest first, and
+	// head is the sequence number of the oldest.
+	sizes   []int64
+	head    uint64
+	size    int64
+	dropped uint64
+}
+
+// OpenSpool opens or creates the spool at path, holding at most maxBytes of
+// requests. A partial entry left by a crash is removed.
+func OpenSpool(path string, maxBytes int64, overflow SpoolOverflow) (*Spool, error) {
+	switch overflow {
+	case SpoolRejectNew, SpoolDropOldest:
+	case "":
+		overflow = SpoolRejectNew
+	default:
+		return nil, fmt.Errorf("unknown spool overflow policy: %s", overflow)
+	}
+
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("spool size limit must be greater than zero, got: %d", maxBytes)
+	}
+
+	s := &Spool{
+		path:     path,
+		maxBytes: maxBytes,
+		overflow: overflow,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s.file = file
+
+	return s, nil
+}
+
+// load reads the sizes of the entries already in the file.
+func (s *Spool) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Removing %d bytes of a partial entry from spool: %s\n", len(line), s.path)
+				return os.Truncate(s.path, s.size)
+			}
+
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		s.sizes = append(s.sizes, int64(len(line)))
+		s.size += int64(len(line))
+	}
+}
+
+// Append adds a request to the end of the spool.
+func (s *Spool) Append(subject string, data []byte) error {
+	line, err := json.Marshal(spoolEntry{Subject: subject, Data: data})
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	size := int64(len(line))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if size > s.maxBytes {
+		return fmt.Errorf("%w: request is %d bytes, limit: %d bytes", ErrSpoolFull, size, s.maxBytes)
+	}
+
+	if s.size+size > s.maxBytes {
+		if s.overflow == SpoolRejectNew {
+			return fmt.Errorf("%w: %d requests, %d bytes", ErrSpoolFull, len(s.sizes), s.size)
+		}
+
+		if err := s.dropOldest(size); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+
+	s.sizes = append(s.sizes, size)
+	s.size += size
+
+	return nil
+}
+
+// dropOldest makes room for size bytes. At least a tenth of the limit is
+// freed, so that a full spool isn't rewritten for every request.
+func (s *Spool) dropOldest(size int64) error {
+	free := s.maxBytes / 10
+	if free < size {
+		free = size
+	}
+
+	var n int
+	var freed int64
+	for n < len(s.sizes) && (freed < free || s.size-freed+size > s.maxBytes) {
+		freed += s.sizes[n]
+		n++
+	}
+
+	log.Printf("Spool is full, dropping the oldest %d requests (%d bytes)\n", n, freed)
+
+	s.dropped += uint64(n)
+
+	return s.removeLocked(n)
+}
+
+// Depth returns the number of requests in the spool.
+func (s *Spool) Depth() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.sizes)
+}
+
+// Size returns the number of bytes in the spool.
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size
+}
+
+// Dropped returns the number of requests dropped with SpoolDropOldest.
+func (s *Spool) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// Close closes the spool's file, the requests in it are kept.
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file.Close()
+}
+
+// peek returns up to n of the oldest entries, and the sequence number of the
+// first.
+func (s *Spool) peek(n int) (uint64, []spoolEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	var entries []spoolEntry
+
+	reader := bufio.NewReader(file)
+	for len(entries) < n && len(entries) < len(s.sizes) {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return 0, nil, err
+		}
+
+		entry := spoolEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, nil, fmt.Errorf("unable to read spool entry %d: %w", s.head+uint64(len(entries)), err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return s.head, entries, nil
+}
+
+// removeBefore removes the entries before the sequence number next, any of
+// which were already dropped are skipped.
+func (s *Spool) removeBefore(next uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if next <= s.head {
+		return nil
+	}
+
+	n := int(next - s.head)
+	if n > len(s.sizes) {
+		n = len(s.sizes)
+	}
+
+	return s.removeLocked(n)
+}
+
+// removeLocked rewrites the file without the oldest n entries, the lock must
+// be held.
+func (s *Spool) removeLocked(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	var offset int64
+	for _, size := range s.sizes[:n] {
+		offset += size
+	}
+
+	src, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+
+	s.sizes = append([]int64{}, s.sizes[n:]...)
+	s.head += uint64(n)
+	s.size -= offset
+
+	return nil
+}
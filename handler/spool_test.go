@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+func Test_Spool_AppendAndRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+
+	s, err := OpenSpool(path, 1024*1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := s.Append("faas-request", []byte(fmt.Sprintf("request-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, entries, err := s.peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head != 0 || len(entries) != 2 || string(entries[1].Data) != "request-1" {
+		t.Fatalf("want the oldest 2 requests from 0, got %d from %d", len(entries), head)
+	}
+
+	if err := s.removeBefore(head + 2); err != nil {
+		t.Fatal(err)
+	}
+
+	head, entries, err = s.peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head != 2 || len(entries) != 1 || string(entries[0].Data) != "request-2" {
+		t.Errorf("want request-2 left, got %d entries from %d", len(entries), head)
+	}
+
+	if s.Depth() != 1 {
+		t.Errorf("want depth 1, got %d", s.Depth())
+	}
+}
+
+func Test_Spool_RejectNew(t *testing.T) {
+	s, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), 100, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var full error
+	for i := 0; i < 10 && full == nil; i++ {
+		full = s.Append("faas-request", []byte("0123456789"))
+	}
+
+	if !errors.Is(full, ErrSpoolFull) {
+		t.Fatalf("want ErrSpoolFull, got %v", full)
+	}
+
+	if s.Size() > 100 {
+		t.Errorf("want at most 100 bytes, got %d", s.Size())
+	}
+}
+
+func Test_Spool_DropOldest(t *testing.T) {
+	s, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), 200, SpoolDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := s.Append("faas-request", []byte(fmt.Sprintf("request-%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Dropped() == 0 || s.Size() > 200 {
+		t.Fatalf("want requests dropped to stay within 200 bytes, got %d dropped and %d bytes", s.Dropped(), s.Size())
+	}
+
+	_, entries, err := s.peek(s.Depth())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(entries[len(entries)-1].Data); got != "request-19" {
+		t.Errorf("want the newest request kept, got %s", got)
+	}
+
+	if got, want := string(entries[0].Data), fmt.Sprintf("request-%02d", s.Dropped()); got != want {
+		t.Errorf("want %s as the oldest, got %s", want, got)
+	}
+}
+
+func Test_OpenSpool_KeepsRequestsAndRemovesPartialEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+
+	s, err := OpenSpool(path, 1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Append("faas-request", []byte("request-0"))
+	s.Close()
+
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"subject":"faas-req`)
+	file.Close()
+
+	s, err = OpenSpool(path, 1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Depth() != 1 {
+		t.Fatalf("want 1 request kept, got %d", s.Depth())
+	}
+
+	if err := s.Append("faas-request", []byte("request-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries, err := s.peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || string(entries[1].Data) != "request-1" {
+		t.Errorf("want 2 requests after the partial entry was removed, got %d", len(entries))
+	}
+}
+
+func Test_NATSQueue_SpoolsWhilstDisconnected(t *testing.T) {
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), 1024*1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	q := newTestQueue(nil, 0)
+	q.Spool = spool
+
+	for _, function := range []string{"figlet", "nodeinfo"} {
+		if err := q.QueueContext(context.Background(), &ftypes.QueueRequest{Function: function}); err != nil {
+			t.Fatalf("want the request spooled, got %s", err)
+		}
+	}
+
+	if spool.Depth() != 2 {
+		t.Fatalf("want 2 requests spooled, got %d", spool.Depth())
+	}
+
+	conn := &fakeConn{}
+	q.nc = conn
+
+	if err := q.ReplaySpool(); err != nil {
+		t.Fatal(err)
+	}
+
+	if spool.Depth() != 0 || len(conn.published) != 2 {
+		t.Fatalf("want 2 requests replayed, got %d with %d left", len(conn.published), spool.Depth())
+	}
+
+	if !strings.Contains(string(conn.published[0]), "figlet") || !strings.Contains(string(conn.published[1]), "nodeinfo") {
+		t.Errorf("want requests replayed in order, got %s then %s", conn.published[0], conn.published[1])
+	}
+
+	if q.replaying {
+		t.Errorf("want new requests published once the spool is empty")
+	}
+}
+
+func Test_NATSQueue_ReplaysSpoolOnReconnect(t *testing.T) {
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), 1024*1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	q := newTestQueue(&fakeConn{}, 0)
+	q.Spool = spool
+
+	q.onStateChange(nats.StateConnected, nats.StateReconnecting)
+	if q.nc != nil {
+		t.Fatal("want no connection once it is lost")
+	}
+
+	if err := q.QueueContext(context.Background(), &ftypes.QueueRequest{Function: "figlet"}); err != nil {
+		t.Fatalf("want the request spooled, got %s", err)
+	}
+
+	conn := &fakeConn{}
+	if err := q.onConnect(conn); err != nil {
+		t.Fatal(err)
+	}
+	q.onStateChange(nats.StateReconnecting, nats.StateConnected)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if spool.Depth() != 0 {
+		t.Fatalf("want the spool replayed after reconnecting, %d left", spool.Depth())
+	}
+}
+
+func Test_NATSQueue_SpoolsWhilstReconnecting(t *testing.T) {
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "spool"), 1024*1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	q := newTestQueue(nil, 0)
+	q.Spool = spool
+
+	if err := q.QueueContext(context.Background(), &ftypes.QueueRequest{Function: "figlet"}); err != nil {
+		t.Fatalf("want the request spooled, got %s", err)
+	}
+
+	conn := &fakeConn{}
+	if err := q.onConnect(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued after the connection is made, before the replay starts.
+	if _, err := q.publish(context.Background(), &ftypes.QueueRequest{Function: "nodeinfo"}, nil); err != nil {
+		t.Fatalf("want the request spooled, got %s", err)
+	}
+
+	if spool.Depth() != 2 || conn.waiting() != 0 {
+		t.Fatalf("want the request spooled behind the first, got %d spooled and %d published", spool.Depth(), conn.waiting())
+	}
+
+	q.onStateChange(nats.StateReconnecting, nats.StateConnected)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if spool.Depth() != 0 || len(conn.published) != 2 {
+		t.Fatalf("want 2 requests replayed, got %d with %d left", len(conn.published), spool.Depth())
+	}
+
+	if !strings.Contains(string(conn.published[0]), "figlet") || !strings.Contains(string(conn.published[1]), "nodeinfo") {
+		t.Errorf("want requests replayed in order, got %s then %s", conn.published[0], conn.published[1])
+	}
+}
+
+func Test_NATSQueue_ReplaySpool_ErrorStopsReplaying(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool")
+	spool, err := OpenSpool(path, 1024*1024, SpoolRejectNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	if err := spool.Append("faas-request", []byte("request-0")); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newTestQueue(nil, 0)
+	q.Spool = spool
+
+	if err := q.ReplaySpool(); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("want ErrDisconnected, got: %v", err)
+	}
+
+	if q.replaying {
+		t.Fatal("want replaying stopped when disconnected")
+	}
+
+	conn := &fakeConn{}
+	q.nc = conn
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.ReplaySpool(); err == nil {
+		t.Fatal("want the error reading the spool")
+	}
+
+	if q.replaying {
+		t.Fatal("want replaying stopped when the spool can't be read")
+	}
+
+	// Published rather than spooled behind a replay which stopped.
+	ack, err := q.publish(context.Background(), &ftypes.QueueRequest{Function: "figlet"}, nil)
+	if err != nil || len(ack.GUID) == 0 || conn.waiting() != 1 {
+		t.Errorf("want the request published, got %d waiting: %v", conn.waiting(), err)
+	}
+}
@@ -0,0 +1,63 @@
+package lifecycle
+
+import "time"
+
+// DefaultSubject is the NATS subject lifecycle events are published to.
+const DefaultSubject = "faas-request-status"
+
+// State of an asynchronous invocation.
+type State string
+
+const (
+	// Queued by the publisher.
+	Queued State = "queued"
+
+	// Received by a queue worker.
+	Received State = "received"
+
+	// Invoking the function.
+	Invoking State = "invoking"
+
+	// Retrying a message which was redelivered by NATS Streaming.
+	Retrying State = "retrying"
+
+	// Succeeded with a 2xx status from the function.
+	Succeeded State = "succeeded"
+
+	// Failed with a non-2xx status, or the function could not be reached.
+	Failed State = "failed"
+
+	// Expired before it could be invoked.
+	Expired State = "expired"
+
+	// DeadLettered was given up on and moved aside without being invoked.
+	DeadLettered State = "dead-lettered"
+)
+
+// Event records the transition of an invocation to a State.
+type Event struct {
+	CallID    string    `json:"callId"`
+	State     State     `json:"state"`
+	Function  string    `json:"function"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// WorkerID is the client ID of the publisher or worker which recorded
+	// the event.
+	WorkerID string `json:"workerId,omitempty"`
+
+	// StatusCode from the function, if it was invoked.
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Message gives the reason for the transition, if any.
+	Message string `json:"message,omitempty"`
+}
+
+// Final returns true when no further transitions are expected.
+func (s State) Final() bool {
+	switch s {
+	case Succeeded, Failed, Expired, DeadLettered:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,22 @@
+package lifecycle
+
+import "testing"
+
+func TestFinal(t *testing.T) {
+	final := map[State]bool{
+		Queued:       false,
+		Received:     false,
+		Invoking:     false,
+		Retrying:     false,
+		Succeeded:    true,
+		Failed:       true,
+		Expired:      true,
+		DeadLettered: true,
+	}
+
+	for state, want := range final {
+		if got := state.Final(); got != want {
+			t.Errorf("%s want Final() %v, got %v", state, want, got)
+		}
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -12,11 +10,9 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
-	stan "github.com/nats-io/stan.go"
-
 	ftypes "github.com/openfaas/faas-provider/types"
 	"github.com/openfaas/nats-queue-worker/nats"
 	"github.com/openfaas/nats-queue-worker/version"
@@ -28,7 +24,7 @@ func main() {
 	readConfig := ReadConfig{}
 	config, err := readConfig.Read()
 	if err != nil {
-		panic(err)
+		log.Fatalf("Invalid config:\n%s", err)
 	}
 
 	log.SetFlags(0)
@@ -39,158 +35,132 @@ func main() {
 	log.Printf("Starting queue-worker (Community Edition). Concurrency: %d\tChannel: %s\tVersion: %s\tGit Commit: %s",
 		config.MaxInflight, sharedQueue, release, sha)
 
-	log.Printf("[Warning] NATS Streaming is deprecated and will be removed in a future release. See: https://www.openfaas.com/blog/jetstream-for-openfaas/")
-
-	client := makeClient()
-
-	counter := uint64(0)
-	messageHandler := func(msg *stan.Msg) {
-		i := atomic.AddUint64(&counter, 1)
-
-		log.Printf("[#%d] Received on [%s]: '%s'", i, msg.Subject, msg)
-
-		started := time.Now()
-
-		req := ftypes.QueueRequest{}
-		if err := json.Unmarshal(msg.Data, &req); err != nil {
-			log.Printf("[#%d] Unmarshal error: %s with data %s", i, err, msg.Data)
-			return
-		}
-
-		xCallID := req.Header.Get("X-Call-Id")
-
-		functionURL := makeFunctionURL(&req, &config, req.Path, req.QueryString)
-		fmt.Printf("[#%d] Invoking: %s with %d bytes, via: %s", i, req.Function, len(req.Body), functionURL)
-
-		if config.DebugPrintBody {
-			fmt.Println(string(req.Body))
-		}
-
-		start := time.Now()
-		request, err := http.NewRequest(http.MethodPost, functionURL, bytes.NewReader(req.Body))
-		if err != nil {
-			log.Printf("[#%d] Unable to post message due to invalid URL, error: %s", i, err.Error())
-			return
-		}
-
-		req.Header.Set("User-Agent", "openfaas-ce/nats-queue-worker")
+	log.Printf("Config: %+v", config.Redacted())
 
-		defer request.Body.Close()
-		copyHeaders(request.Header, &req.Header)
-
-		res, err := client.Do(request)
-
-		var status int
-		var functionResult []byte
-
-		var statusCode int
-		if err != nil {
-			statusCode = http.StatusServiceUnavailable
-		} else {
-			statusCode = res.StatusCode
-		}
-
-		duration := time.Since(start)
-
-		log.Printf("[#%d] Invoked: %s [%d] in %fs", i, req.Function, statusCode, duration.Seconds())
-
-		if err != nil {
-			status = http.StatusServiceUnavailable
-
-			log.Printf("[#%d] Error invoking %s, error: %s", i, req.Function, err)
-
-			timeTaken := time.Since(started).Seconds()
+	if config.DirectFunctions {
+		log.Printf("Invoking functions directly via: %s", config.FunctionAddress("{name}", "{namespace}"))
+	}
 
-			if req.CallbackURL != nil {
-				resultStatusCode, err := postResult(&client,
-					res,
-					functionResult,
-					req.CallbackURL.String(),
-					xCallID,
-					status,
-					req.Function,
-					timeTaken)
+	log.Printf("[Warning] NATS Streaming is deprecated and will be removed in a future release. See: https://www.openfaas.com/blog/jetstream-for-openfaas/")
 
-				if err != nil {
-					log.Printf("[#%d] Posted callback to: %s - status %d, error: %s", i, req.CallbackURL.String(), http.StatusServiceUnavailable, err.Error())
-				} else {
-					log.Printf("[#%d] Posted result to %s - status: %d", i, req.CallbackURL.String(), resultStatusCode)
-				}
-			}
+	client := makeClient()
 
-			return
-		}
+	callbackClient := makeCallbackClient(config.CallbackPolicy)
 
-		if res.Body != nil {
-			defer res.Body.Close()
+	w := newWorker(config, &client, &callbackClient)
 
-			resData, err := io.ReadAll(res.Body)
-			functionResult = resData
+	store, err := newResultStore(config)
+	if err != nil {
+		panic(err)
+	}
 
-			if err != nil {
-				log.Printf("[#%d] Error reading body for: %s, error: %s", i, req.Function, err)
-			}
+	if store != nil {
+		w.store = store
+		httpMux.Handle("GET /results/{callId}", requireTokenIfSet(config.AdminToken, makeResultsHandler(store)))
+	}
 
-			if config.WriteDebug {
-				fmt.Println(string(functionResult))
-			} else {
-				fmt.Printf("[#%d] %s returned %d bytes", i, req.Function, len(functionResult))
-			}
-		}
+	go serveHTTP(config.HTTPPort)
 
-		timeTaken := time.Since(started).Seconds()
-
-		if req.CallbackURL != nil {
-			log.Printf("[#%d] Callback to: %s", i, req.CallbackURL.String())
-
-			resultStatusCode, err := postResult(&client,
-				res,
-				functionResult,
-				req.CallbackURL.String(),
-				xCallID,
-				res.StatusCode,
-				req.Function,
-				timeTaken)
-
-			if err != nil {
-				log.Printf("[#%d] Error posting to callback-url: %s", i, err)
-			} else {
-				log.Printf("[#%d] Posted result for %s to callback-url: %s, status: %d", i, req.Function, req.CallbackURL.String(), resultStatusCode)
-			}
-		}
+	clientID := config.NatsClientID
+	if len(clientID) == 0 {
+		clientID = nats.NewClientID("faas-worker-", hostname, config.NatsClientIDStrategy)
+	}
 
+	var status *statusTracker
+	if config.TrackStatus {
+		status = newStatusTracker(clientID, config.StatusSubject, config.StatusTTL, config.StatusMaxBytes)
+		w.status = status
+		httpMux.Handle("GET /status/{callId}", requireTokenIfSet(config.AdminToken, makeStatusHandler(status)))
 	}
 
-	natsURL := fmt.Sprintf("nats://%s:%d", config.NatsAddress, config.NatsPort)
+	natsURL := config.NatsOptions.URL(fmt.Sprintf("nats://%s:%d", config.NatsAddress, config.NatsPort))
 
 	natsQueue := NATSQueue{
 		clusterID: config.NatsClusterName,
-		clientID:  "faas-worker-" + nats.GetClientID(hostname),
+		clientID:  clientID,
 		natsURL:   natsURL,
 
+		connectOptions: config.NatsOptions,
 		connMutex:      &sync.RWMutex{},
+		events:         nats.NewEvents(),
 		maxReconnect:   config.MaxReconnect,
 		reconnectDelay: config.ReconnectDelay,
-		quitCh:         make(chan struct{}),
 
 		subject:        sharedQueue,
 		qgroup:         config.NatsQueueGroup,
-		messageHandler: messageHandler,
+		messageHandler: w.handle,
 		maxInFlight:    config.MaxInflight,
 		ackWait:        config.AckWait,
+
+		durableName:        config.DurableName,
+		startPosition:      config.StartPosition,
+		unsubscribeOnClose: config.UnsubscribeOnClose,
+	}
+
+	w.results = &natsQueue
+
+	natsQueue.OnEvent(observeConnection)
+	httpMux.Handle("GET /healthz", makeHealthHandler(&natsQueue))
+
+	if config.GatewayHealthCheck {
+		if config.DirectFunctions {
+			log.Printf("[Warning] gateway_health_check is ignored as functions are invoked directly")
+		} else {
+			healthClient := makeClient()
+			healthClient.Timeout = config.GatewayHealthInterval
+
+			w.gateway = newGatewayMonitor(config, &healthClient, &natsQueue)
+			go w.gateway.run()
+		}
+	}
+
+	if config.AdaptiveConcurrency.Enabled {
+		w.concurrency = newAdaptiveLimiter(config.AdaptiveConcurrency, config.MaxInflight, natsQueue.setWorkerLimit)
+	}
+
+	if status != nil {
+		status.publisher = &natsQueue
+		natsQueue.statusSubject = config.StatusSubject
+		natsQueue.statusHandler = status.Ingest
+	}
+
+	if len(config.AdminToken) > 0 {
+		registerAdmin(httpMux, config.AdminToken, &natsQueue, w)
 	}
 
 	if err := natsQueue.connect(); err != nil {
 		log.Panic(err)
 	}
 
+	r := &reloader{
+		readConfig: readConfig,
+		worker:     w,
+		queue:      &natsQueue,
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Printf("Received SIGHUP, reloading config")
+			r.reload()
+		}
+	}()
+
+	if len(config.ConfigFile) > 0 {
+		go watchConfigFile(config.ConfigFile, configPollInterval, func() {
+			log.Printf("Config file %s changed, reloading config", config.ConfigFile)
+			r.reload()
+		})
+	}
+
 	// Wait for a SIGINT (perhaps triggered by user with CTRL-C)
 	// Run cleanup when signal is received
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
 	<-signalChan
 
-	fmt.Printf("\nReceived an interrupt, unsubscribing and closing connection...\n\n")
+	fmt.Printf("\nReceived an interrupt, closing connection...\n\n")
 	if err := natsQueue.closeConnection(); err != nil {
 		log.Panicf("Cannot close connection to %s because of an error: %v", natsQueue.natsURL, err)
 	}
@@ -219,15 +189,13 @@ func makeClient() http.Client {
 	return proxyClient
 }
 
-func postResult(client *http.Client, functionRes *http.Response, result []byte, callbackURL string, xCallID string,
+// postResult sends the function's result to callbackURL. When the result is
+// being streamed from the function, the response size and truncation headers
+// are sent as trailers as they are only known once the body has been read.
+func postResult(client *http.Client, functionRes *http.Response, result io.Reader, body *limitedReader, callbackURL string, xCallID string,
 	statusCode int, functionName string, timeTaken float64) (int, error) {
-	var reader io.Reader
 
-	if result != nil {
-		reader = bytes.NewReader(result)
-	}
-
-	request, err := http.NewRequest(http.MethodPost, callbackURL, reader)
+	request, err := http.NewRequest(http.MethodPost, callbackURL, result)
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("unable to post result, error: %s", err.Error())
 	}
@@ -236,6 +204,14 @@ func postResult(client *http.Client, functionRes *http.Response, result []byte,
 		copyHeaders(request.Header, &functionRes.Header)
 	}
 
+	if body != nil {
+		if body.finished {
+			body.setHeaders(request.Header)
+		} else {
+			body.declareTrailers(request)
+		}
+	}
+
 	request.Header.Set("X-Duration-Seconds", fmt.Sprintf("%f", timeTaken))
 	request.Header.Set("X-Function-Status", fmt.Sprintf("%d", statusCode))
 	request.Header.Set("X-Function-Name", functionName)
@@ -247,7 +223,7 @@ func postResult(client *http.Client, functionRes *http.Response, result []byte,
 	res, err := client.Do(request)
 
 	if err != nil {
-		return http.StatusBadGateway, fmt.Errorf("error posting result to URL %s %s", callbackURL, err.Error())
+		return http.StatusBadGateway, fmt.Errorf("error posting result to URL %s %w", callbackURL, err)
 	}
 
 	if request.Body != nil {
@@ -279,6 +255,15 @@ func makeFunctionURL(req *ftypes.QueueRequest, config *QueueWorkerConfig, path,
 		pathVal = path
 	}
 
+	if config.DirectFunctions {
+		name, namespace := splitFunctionName(strings.Trim(req.Function, "/"), config.DefaultNamespace)
+
+		return fmt.Sprintf("http://%s%s%s",
+			config.FunctionAddress(name, namespace),
+			pathVal,
+			qs)
+	}
+
 	return fmt.Sprintf("http://%s/function/%s%s%s",
 		config.GatewayAddressURL(),
 		strings.Trim(req.Function, "/"),
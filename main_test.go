@@ -59,3 +59,55 @@ func Test_makeFunctionURL_DefaultPathQS_WithPath(t *testing.T) {
 		t.Errorf("want %s, got %s", wantURL, fnURL)
 	}
 }
+
+func Test_makeFunctionURL_DirectFunctions_DefaultNamespace(t *testing.T) {
+	config := QueueWorkerConfig{
+		DirectFunctions:  true,
+		DefaultNamespace: "openfaas-fn",
+	}
+	req := ftypes.QueueRequest{
+		Function:    "function1",
+		Path:        "/resources/main.css",
+		QueryString: "user=1",
+	}
+
+	fnURL := makeFunctionURL(&req, &config, req.Path, req.QueryString)
+	wantURL := "http://function1.openfaas-fn:8080/resources/main.css?user=1"
+	if fnURL != wantURL {
+		t.Errorf("want %s, got %s", wantURL, fnURL)
+	}
+}
+
+func Test_makeFunctionURL_DirectFunctions_WithNamespaceAndSuffix(t *testing.T) {
+	config := QueueWorkerConfig{
+		DirectFunctions:  true,
+		DefaultNamespace: "openfaas-fn",
+		FunctionSuffix:   "svc.cluster.local",
+	}
+	req := ftypes.QueueRequest{
+		Function: "function1.staging-fn",
+	}
+
+	fnURL := makeFunctionURL(&req, &config, req.Path, req.QueryString)
+	wantURL := "http://function1.staging-fn.svc.cluster.local:8080/"
+	if fnURL != wantURL {
+		t.Errorf("want %s, got %s", wantURL, fnURL)
+	}
+}
+
+func Test_makeFunctionURL_DirectFunctions_CustomTemplate(t *testing.T) {
+	config := QueueWorkerConfig{
+		DirectFunctions:     true,
+		DefaultNamespace:    "openfaas-fn",
+		FunctionURLTemplate: "{namespace}-{name}:8081",
+	}
+	req := ftypes.QueueRequest{
+		Function: "function1",
+	}
+
+	fnURL := makeFunctionURL(&req, &config, req.Path, req.QueryString)
+	wantURL := "http://openfaas-fn-function1:8081/"
+	if fnURL != wantURL {
+		t.Errorf("want %s, got %s", wantURL, fnURL)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	invocationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_worker_invocations_total",
+		Help: "Function invocations by status code",
+	}, []string{"function_name", "namespace", "code"})
+
+	invocationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "queue_worker_invocation_duration_seconds",
+		Help:    "Duration of function invocations",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"function_name", "namespace"})
+
+	inflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_worker_inflight",
+		Help: "Function invocations in progress",
+	}, []string{"namespace"})
+
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_worker_rejected_total",
+		Help: "Messages rejected without invoking the function",
+	}, []string{"namespace", "reason"})
+
+	callbacksRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_worker_callbacks_rejected_total",
+		Help: "Results not posted because the callback policy rejected the callback URL",
+	}, []string{"namespace"})
+
+	concurrencyLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "queue_worker_concurrency_limit",
+		Help: "Invocations which can run concurrently when adaptive_concurrency is enabled",
+	})
+
+	gatewayHealth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "queue_worker_gateway_healthy",
+		Help: "Whether the gateway is healthy when gateway_health_check is enabled: 1 healthy, 0 unhealthy",
+	})
+
+	coldStartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_worker_cold_starts_total",
+		Help: "Invocations which waited for a function to scale from zero, by whether it became ready",
+	}, []string{"result"})
+
+	coldStartDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "queue_worker_cold_start_duration_seconds",
+		Help:    "Time waited for a function to scale from zero",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 8),
+	})
+
+	natsConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "queue_worker_nats_connected",
+		Help: "Whether the worker is connected to NATS Streaming: 1 connected, 0 disconnected",
+	})
+
+	natsConnectionEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_worker_nats_connection_events_total",
+		Help: "Events in the lifecycle of the connection to NATS Streaming, such as reconnecting and subscription_lost",
+	}, []string{"event"})
+
+	circuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_worker_circuit_state",
+		Help: "State of each function's circuit breaker: 0 closed, 1 open, 2 half-open",
+	}, []string{"function_name"})
+)
+
+// httpMux serves the worker's HTTP endpoints.
+var httpMux = http.NewServeMux()
+
+func init() {
+	httpMux.Handle("/metrics", promhttp.Handler())
+}
+
+// serveHTTP exposes the worker's HTTP endpoints on port, it blocks until the
+// server stops.
+func serveHTTP(port int) {
+	if port <= 0 {
+		return
+	}
+
+	log.Printf("Listening for HTTP on: %d", port)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), httpMux); err != nil {
+		log.Printf("HTTP server error: %s", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NamespaceConfig holds the settings applied to functions in a namespace.
+type NamespaceConfig struct {
+	// MaxInflight limits the concurrent invocations for the namespace,
+	// zero means it is only bounded by max_inflight.
+	MaxInflight int
+
+	// Timeout for invoking a function, zero means no timeout.
+	Timeout time.Duration
+
+	// DisableCallbacks stops results being posted to callback URLs.
+	DisableCallbacks bool
+}
+
+// namespacePolicy decides which namespaces may be invoked and limits the
+// concurrency of each.
+type namespacePolicy struct {
+	allowed  map[string]bool
+	settings map[string]NamespaceConfig
+	slots    map[string]*semaphore
+}
+
+func newNamespacePolicy(config QueueWorkerConfig) *namespacePolicy {
+	p := &namespacePolicy{
+		allowed:  map[string]bool{},
+		settings: map[string]NamespaceConfig{},
+		slots:    map[string]*semaphore{},
+	}
+
+	for _, namespace := range config.AllowedNamespaces {
+		p.allowed[namespace] = true
+	}
+
+	for namespace, settings := range config.Namespaces {
+		p.settings[namespace] = settings
+
+		if settings.MaxInflight > 0 {
+			p.slots[namespace] = newSemaphore(settings.MaxInflight)
+		}
+	}
+
+	return p
+}
+
+// Allowed returns true when the namespace can be invoked, all namespaces are
+// allowed unless an allowlist is configured.
+func (p *namespacePolicy) Allowed(namespace string) bool {
+	if len(p.allowed) == 0 {
+		return true
+	}
+
+	return p.allowed[namespace]
+}
+
+// Settings returns the settings for a namespace, or the zero value if none
+// were configured.
+func (p *namespacePolicy) Settings(namespace string) NamespaceConfig {
+	return p.settings[namespace]
+}
+
+// Acquire waits up to wait for the namespace to have capacity for another
+// invocation, ok is false when it didn't. The returned func must be called
+// once the invocation has completed.
+func (p *namespacePolicy) Acquire(namespace string, wait time.Duration) (release func(), ok bool) {
+	return tryAcquireSlot(p.slots, namespace, wait)
+}
+
+// maxSlotWait bounds how long a message waits for a namespace or function to
+// have capacity.
+const maxSlotWait = time.Second
+
+// slotWait is how long a message waits for capacity before it is left for
+// redelivery, well under ackWait, so that one busy namespace doesn't hold
+// every worker whilst other functions' messages wait behind it.
+func slotWait(ackWait time.Duration) time.Duration {
+	if wait := ackWait / 10; wait < maxSlotWait {
+		return wait
+	}
+
+	return maxSlotWait
+}
+
+// splitFunctionName separates a function given as name.namespace into its
+// parts, using defaultNamespace when no namespace is given.
+func splitFunctionName(function, defaultNamespace string) (string, string) {
+	if i := strings.Index(function, "."); i > -1 {
+		return function[:i], function[i+1:]
+	}
+
+	return function, defaultNamespace
+}
+
+// parseNamespaceValues parses a list in the form of: ns1=value1,ns2=value2
+func parseNamespaceValues(value string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("invalid value %q, want namespace=value", pair)
+		}
+
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return values, nil
+}
+
+// parseList parses a comma separated list, ignoring empty entries.
+func parseList(value string) []string {
+	var values []string
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
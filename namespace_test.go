@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_splitFunctionName_WithNamespace(t *testing.T) {
+	name, namespace := splitFunctionName("figlet.staging-fn", "openfaas-fn")
+
+	if name != "figlet" {
+		t.Errorf("want name %q, got %q", "figlet", name)
+	}
+
+	if namespace != "staging-fn" {
+		t.Errorf("want namespace %q, got %q", "staging-fn", namespace)
+	}
+}
+
+func Test_splitFunctionName_DefaultNamespace(t *testing.T) {
+	name, namespace := splitFunctionName("figlet", "openfaas-fn")
+
+	if name != "figlet" {
+		t.Errorf("want name %q, got %q", "figlet", name)
+	}
+
+	if namespace != "openfaas-fn" {
+		t.Errorf("want namespace %q, got %q", "openfaas-fn", namespace)
+	}
+}
+
+func Test_parseNamespaceValues(t *testing.T) {
+	values, err := parseNamespaceValues("staging-fn=2, dev-fn=1,")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 || values["staging-fn"] != "2" || values["dev-fn"] != "1" {
+		t.Errorf("want staging-fn=2 and dev-fn=1, got %v", values)
+	}
+}
+
+func Test_parseNamespaceValues_Invalid(t *testing.T) {
+	_, err := parseNamespaceValues("staging-fn")
+	if err == nil {
+		t.Errorf("want error for a value without a namespace")
+	}
+}
+
+func Test_namespacePolicy_AllowsAllWithoutAllowlist(t *testing.T) {
+	p := newNamespacePolicy(QueueWorkerConfig{})
+
+	if !p.Allowed("openfaas-fn") {
+		t.Errorf("want openfaas-fn to be allowed")
+	}
+}
+
+func Test_namespacePolicy_Allowlist(t *testing.T) {
+	p := newNamespacePolicy(QueueWorkerConfig{
+		AllowedNamespaces: []string{"openfaas-fn"},
+	})
+
+	if !p.Allowed("openfaas-fn") {
+		t.Errorf("want openfaas-fn to be allowed")
+	}
+
+	if p.Allowed("kube-system") {
+		t.Errorf("want kube-system to be rejected")
+	}
+}
+
+func Test_namespacePolicy_AcquireLimitsConcurrency(t *testing.T) {
+	p := newNamespacePolicy(QueueWorkerConfig{
+		Namespaces: map[string]NamespaceConfig{
+			"staging-fn": {MaxInflight: 1},
+		},
+	})
+
+	release, ok := p.Acquire("staging-fn", 0)
+	if !ok {
+		t.Fatal("want the first Acquire to succeed")
+	}
+
+	start := time.Now()
+	if _, ok := p.Acquire("staging-fn", 50*time.Millisecond); ok {
+		t.Fatalf("want the second Acquire to give up whilst the namespace is full")
+	}
+
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > time.Second {
+		t.Errorf("want the second Acquire to wait 50ms, waited %s", waited)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if release, ok := p.Acquire("staging-fn", time.Second); ok {
+			release()
+			close(acquired)
+		}
+	}()
+
+	release()
+
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want the waiting Acquire to succeed once released")
+	}
+
+	if _, ok := p.Acquire("openfaas-fn", 0); !ok {
+		t.Errorf("want namespaces without a limit to be unlimited")
+	}
+}
+
+func Test_slotWait(t *testing.T) {
+	if got := slotWait(30 * time.Second); got != maxSlotWait {
+		t.Errorf("want %s, got %s", maxSlotWait, got)
+	}
+
+	if got := slotWait(5 * time.Second); got != 500*time.Millisecond {
+		t.Errorf("want a tenth of ack_wait, got %s", got)
+	}
+}
@@ -1,7 +1,9 @@
 package nats
 
 import (
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetClientID(t *testing.T) {
@@ -21,3 +23,51 @@ func TestGetClientIDWhenHostHasUnsupportedCharacters(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNewClientID(t *testing.T) {
+	if got := NewClientID("faas-worker-", "computer-a.acme.com", ClientIDHostname); got != "faas-worker-computer-a_acme_com" {
+		t.Errorf("want the hostname, got %s", got)
+	}
+
+	a := NewClientID("faas-worker-", "computer-a", ClientIDUnique)
+	b := NewClientID("faas-worker-", "computer-a", ClientIDUnique)
+	if a == b || !strings.HasPrefix(a, "faas-worker-computer-a-") {
+		t.Errorf("want unique IDs with the hostname, got %s and %s", a, b)
+	}
+
+	if GetClientID(a) != a {
+		t.Errorf("want only supported characters, got %s", a)
+	}
+}
+
+func TestParseClientIDStrategy(t *testing.T) {
+	if got, err := ParseClientIDStrategy(""); err != nil || got != ClientIDHostname {
+		t.Errorf("want hostname by default, got %s, %v", got, err)
+	}
+
+	if _, err := ParseClientIDStrategy("random"); err == nil {
+		t.Errorf("want an error for an unknown strategy")
+	}
+}
+
+func TestConnectOptions_StanOptions(t *testing.T) {
+	if got := len(ConnectOptions{}.StanOptions("nats://nats:4222")); got != 1 {
+		t.Errorf("want only the URL by default, got %d options", got)
+	}
+
+	o := ConnectOptions{
+		Servers:            []string{"nats://a:4222", "nats://b:4222"},
+		ConnectTimeout:     time.Second,
+		PingInterval:       time.Second,
+		PubAckWait:         time.Second,
+		MaxPubAcksInflight: 10,
+	}
+
+	if got := o.URL("nats://nats:4222"); got != "nats://a:4222,nats://b:4222" {
+		t.Errorf("want the servers, got %s", got)
+	}
+
+	if got := len(o.StanOptions("nats://nats:4222")); got != 5 {
+		t.Errorf("want 5 options, got %d", got)
+	}
+}
@@ -0,0 +1,118 @@
+package nats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+	stan "github.com/nats-io/stan.go"
+)
+
+// ConnectOptions tune the connection to NATS Streaming, a zero value keeps
+// the default of the stan client.
+type ConnectOptions struct {
+	// Servers are the NATS URLs to connect to, the client fails over
+	// between them. The URL built from the address and port is used when
+	// empty.
+	Servers []string
+
+	// ConnectTimeout is how long to wait for the connection to be made.
+	ConnectTimeout time.Duration
+
+	// PingInterval is how often the server is pinged, rounded to whole
+	// seconds, and PingMaxOut is the number of pings without a response
+	// after which the connection is lost.
+	PingInterval time.Duration
+	PingMaxOut   int
+
+	// PubAckWait is how long to wait for a published message to be
+	// acknowledged.
+	PubAckWait time.Duration
+
+	// MaxPubAcksInflight is the number of published messages which can be
+	// waiting for an acknowledgement before publishing blocks.
+	MaxPubAcksInflight int
+}
+
+// URL returns the URLs to connect to, Servers when set or natsURL.
+func (o ConnectOptions) URL(natsURL string) string {
+	if len(o.Servers) > 0 {
+		return strings.Join(o.Servers, ",")
+	}
+
+	return natsURL
+}
+
+// StanOptions returns the options for stan.Connect.
+func (o ConnectOptions) StanOptions(natsURL string) []stan.Option {
+	opts := []stan.Option{stan.NatsURL(o.URL(natsURL))}
+
+	if o.ConnectTimeout > 0 {
+		opts = append(opts, stan.ConnectWait(o.ConnectTimeout))
+	}
+
+	if o.PingInterval > 0 || o.PingMaxOut > 0 {
+		interval := stan.DefaultPingInterval
+		if o.PingInterval > 0 {
+			interval = int((o.PingInterval + time.Second/2) / time.Second)
+			if interval < 1 {
+				interval = 1
+			}
+		}
+
+		maxOut := stan.DefaultPingMaxOut
+		if o.PingMaxOut > 0 {
+			maxOut = o.PingMaxOut
+		}
+
+		opts = append(opts, stan.Pings(interval, maxOut))
+	}
+
+	if o.PubAckWait > 0 {
+		opts = append(opts, stan.PubAckWait(o.PubAckWait))
+	}
+
+	if o.MaxPubAcksInflight > 0 {
+		opts = append(opts, stan.MaxPubAcksInflight(o.MaxPubAcksInflight))
+	}
+
+	return opts
+}
+
+// ClientIDStrategy decides how a client ID is built.
+type ClientIDStrategy string
+
+const (
+	// ClientIDHostname uses the hostname, so that a process which restarts
+	// keeps its client ID.
+	ClientIDHostname ClientIDStrategy = "hostname"
+
+	// ClientIDUnique adds a unique suffix to the hostname, so that several
+	// processes on the same host can connect.
+	ClientIDUnique ClientIDStrategy = "unique"
+)
+
+// ParseClientIDStrategy returns the strategy for value, ClientIDHostname
+// when empty.
+func ParseClientIDStrategy(value string) (ClientIDStrategy, error) {
+	switch strategy := ClientIDStrategy(value); strategy {
+	case "":
+		return ClientIDHostname, nil
+	case ClientIDHostname, ClientIDUnique:
+		return strategy, nil
+	}
+
+	return "", fmt.Errorf("unknown client ID strategy: %s, use %s or %s", value, ClientIDHostname, ClientIDUnique)
+}
+
+// NewClientID returns a client ID from prefix and the hostname.
+func NewClientID(prefix, hostname string, strategy ClientIDStrategy) string {
+	id := prefix + GetClientID(hostname)
+
+	if strategy == ClientIDUnique {
+		id += "-" + nuid.Next()
+	}
+
+	return id
+}
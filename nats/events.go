@@ -0,0 +1,126 @@
+package nats
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is a step in the lifecycle of a connection.
+type EventType string
+
+const (
+	// EventConnected is sent when the first connection is made.
+	EventConnected EventType = "connected"
+
+	// EventDisconnected is sent when the connection is lost, Err holds the
+	// reason.
+	EventDisconnected EventType = "disconnected"
+
+	// EventReconnecting is sent before each attempt to reconnect, Err holds
+	// the reason the previous attempt failed.
+	EventReconnecting EventType = "reconnecting"
+
+	// EventReconnected is sent when an attempt to reconnect succeeds.
+	EventReconnected EventType = "reconnected"
+
+	// EventGaveUp is sent after MaxReconnect attempts failed.
+	EventGaveUp EventType = "gave_up"
+
+	// EventClosed is sent when the connection is closed by Close.
+	EventClosed EventType = "closed"
+
+	// EventSubscriptionLost is sent when a subscription on Subject is lost
+	// with the connection.
+	EventSubscriptionLost EventType = "subscription_lost"
+)
+
+// Event describes a change to a connection.
+type Event struct {
+	Type EventType
+
+	// State of the connection after the event.
+	State State
+
+	// Attempt to reconnect, from 1, of MaxAttempts.
+	Attempt     int
+	MaxAttempts int
+
+	// Subject of a subscription which was lost.
+	Subject string
+
+	Err  error
+	Time time.Time
+}
+
+// EventHandler receives events, it must not block as events are delivered
+// one at a time.
+type EventHandler func(Event)
+
+type subscriber struct {
+	id      int
+	handler EventHandler
+}
+
+// Events delivers the events of a connection to each subscribed handler, in
+// the order they happened, and records the state of the connection.
+type Events struct {
+	lock        sync.Mutex
+	subscribers []subscriber
+	next        int
+	state       State
+}
+
+// NewEvents returns Events for a connection which is not yet connected.
+func NewEvents() *Events {
+	return &Events{state: StateDisconnected}
+}
+
+// Subscribe calls handler with each event from now on, until unsubscribe is
+// called.
+func (e *Events) Subscribe(handler EventHandler) (unsubscribe func()) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	id := e.next
+	e.next++
+	e.subscribers = append(e.subscribers, subscriber{id: id, handler: handler})
+
+	return func() {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+
+		for i, s := range e.subscribers {
+			if s.id == id {
+				e.subscribers = append(e.subscribers[:i:i], e.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Emit delivers event to the subscribed handlers, Time is set when zero.
+// Callers emit one event at a time so that handlers see them in order.
+func (e *Events) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	e.lock.Lock()
+	if len(event.State) > 0 {
+		e.state = event.State
+	}
+	subscribers := e.subscribers
+	e.lock.Unlock()
+
+	for _, s := range subscribers {
+		s.handler(event)
+	}
+}
+
+// State returns the state of the connection after the latest event.
+func (e *Events) State() State {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.state
+}
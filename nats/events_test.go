@@ -0,0 +1,47 @@
+package nats
+
+import (
+	"testing"
+)
+
+func TestEvents_DeliversInOrder(t *testing.T) {
+	events := NewEvents()
+
+	if got := events.State(); got != StateDisconnected {
+		t.Errorf("want %s before any event, got %s", StateDisconnected, got)
+	}
+
+	var a, b []EventType
+	events.Subscribe(func(e Event) { a = append(a, e.Type) })
+	unsubscribe := events.Subscribe(func(e Event) { b = append(b, e.Type) })
+
+	events.Emit(Event{Type: EventConnected, State: StateConnected})
+	events.Emit(Event{Type: EventDisconnected, State: StateReconnecting})
+
+	unsubscribe()
+	events.Emit(Event{Type: EventSubscriptionLost, Subject: "faas-request"})
+
+	if len(a) != 3 || a[0] != EventConnected || a[1] != EventDisconnected || a[2] != EventSubscriptionLost {
+		t.Errorf("want every event in order, got %v", a)
+	}
+
+	if len(b) != 2 {
+		t.Errorf("want no events after unsubscribing, got %v", b)
+	}
+
+	if got := events.State(); got != StateReconnecting {
+		t.Errorf("want the state of the latest event with one, got %s", got)
+	}
+}
+
+func TestEvents_SetsTime(t *testing.T) {
+	events := NewEvents()
+
+	var got Event
+	events.Subscribe(func(e Event) { got = e })
+	events.Emit(Event{Type: EventConnected})
+
+	if got.Time.IsZero() {
+		t.Error("want the time of the event")
+	}
+}
@@ -0,0 +1,348 @@
+package nats
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+)
+
+// State of a connection held by a Manager.
+type State string
+
+const (
+	// StateDisconnected is the state before the first connection.
+	StateDisconnected State = "disconnected"
+
+	// StateConnected has a connection to NATS Streaming.
+	StateConnected State = "connected"
+
+	// StateReconnecting lost the connection and is trying to connect again.
+	StateReconnecting State = "reconnecting"
+
+	// StateFailed gave up reconnecting after MaxReconnect attempts.
+	StateFailed State = "failed"
+
+	// StateClosed was closed by Close.
+	StateClosed State = "closed"
+)
+
+const (
+	// DefaultMaxBackoff is the longest wait between attempts to reconnect.
+	DefaultMaxBackoff = time.Minute
+
+	// DefaultJitter randomly shortens each wait by up to a fifth, so that
+	// clients which lost their connection together don't reconnect
+	// together.
+	DefaultJitter = 0.2
+)
+
+// ErrClosed is returned when connecting after the Manager was closed.
+var ErrClosed = errors.New("connection manager is closed")
+
+// Backoff is the wait between attempts to reconnect. It doubles from Initial
+// on each attempt, up to Max, and is shortened by a random fraction of up to
+// Jitter.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Jitter  float64
+}
+
+// Delay returns the wait before the attempt, the first attempt, 0, is made
+// straight away.
+func (b Backoff) Delay(attempt int) time.Duration {
+	if attempt <= 0 || b.Initial <= 0 {
+		return 0
+	}
+
+	max := b.Max
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+
+	delay := b.Initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if b.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * b.Jitter * rand.Float64())
+	}
+
+	return delay
+}
+
+// ManagerConfig configures a Manager.
+type ManagerConfig struct {
+	ClusterID string
+	ClientID  string
+	NatsURL   string
+
+	// Options tune each connection.
+	Options ConnectOptions
+
+	// MaxReconnect is the number of attempts to reconnect after the
+	// connection is lost, before giving up.
+	MaxReconnect int
+
+	// Backoff is the wait between attempts to reconnect.
+	Backoff Backoff
+
+	// OnConnect is called with each new connection before it is used, to
+	// subscribe for instance. When it returns an error the connection is
+	// closed and the attempt has failed.
+	OnConnect func(conn stan.Conn) error
+
+	// OnStateChange is called whenever the state changes, in order.
+	OnStateChange func(from, to State)
+
+	// Subscriptions returns the subjects subscribed with the connection, an
+	// EventSubscriptionLost is sent for each when it is lost.
+	Subscriptions func() []string
+
+	// Events receives the connection's events, NewManager creates them
+	// when nil.
+	Events *Events
+}
+
+// Manager holds a connection to NATS Streaming, and reconnects with
+// exponential backoff when it is lost, until it is closed.
+type Manager struct {
+	config ManagerConfig
+
+	lock  sync.RWMutex
+	conn  stan.Conn
+	state State
+
+	// notify orders transitions, so that OnStateChange sees them in order.
+	notify sync.Mutex
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewManager returns a Manager which is not yet connected.
+func NewManager(config ManagerConfig) *Manager {
+	if config.Events == nil {
+		config.Events = NewEvents()
+	}
+
+	return &Manager{
+		config: config,
+		state:  StateDisconnected,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Connect makes the first connection, it is not retried.
+func (m *Manager) Connect() error {
+	log.Printf("Connect: %s\n", m.config.NatsURL)
+
+	return m.dial(Event{Type: EventConnected})
+}
+
+// Conn returns the connection, or nil whilst disconnected.
+func (m *Manager) Conn() stan.Conn {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.conn
+}
+
+// State returns the state of the connection.
+func (m *Manager) State() State {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.state
+}
+
+// Events returns the connection's events.
+func (m *Manager) Events() *Events {
+	return m.config.Events
+}
+
+// Close stops reconnecting and closes the connection.
+func (m *Manager) Close() error {
+	var err error
+
+	m.closeOnce.Do(func() {
+		close(m.quit)
+
+		var conn stan.Conn
+		m.transition(StateClosed, Event{Type: EventClosed}, func() bool {
+			conn = m.conn
+			m.conn = nil
+			return true
+		})
+
+		if conn != nil {
+			err = conn.Close()
+		}
+	})
+
+	return err
+}
+
+func (m *Manager) dial(event Event) error {
+	opts := append(m.config.Options.StanOptions(m.config.NatsURL),
+		stan.SetConnectionLostHandler(func(lost stan.Conn, err error) {
+			m.lost(lost, err)
+		}),
+	)
+
+	conn, err := stan.Connect(m.config.ClusterID, m.config.ClientID, opts...)
+	if err != nil {
+		return err
+	}
+
+	if m.config.OnConnect != nil {
+		if err := m.config.OnConnect(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	connected := m.transition(StateConnected, event, func() bool {
+		if m.isClosed() {
+			return false
+		}
+
+		m.conn = conn
+		return true
+	})
+
+	if !connected {
+		conn.Close()
+		return ErrClosed
+	}
+
+	return nil
+}
+
+func (m *Manager) lost(conn stan.Conn, err error) {
+	var subjects []string
+	if m.config.Subscriptions != nil {
+		subjects = m.config.Subscriptions()
+	}
+
+	// A connection which was replaced or closed is ignored.
+	current := m.transition(StateReconnecting, Event{Type: EventDisconnected, Err: err}, func() bool {
+		if m.conn != conn || m.isClosed() {
+			return false
+		}
+
+		m.conn = nil
+		return true
+	})
+
+	if !current {
+		return
+	}
+
+	log.Printf("Disconnected from %s: %v\n", m.config.NatsURL, err)
+
+	for _, subject := range subjects {
+		m.emit(Event{Type: EventSubscriptionLost, Subject: subject, Err: err})
+	}
+
+	go m.reconnect()
+}
+
+func (m *Manager) reconnect() {
+	var err error
+	for attempt := 0; attempt < m.config.MaxReconnect; attempt++ {
+		delay := m.config.Backoff.Delay(attempt)
+		if delay > 0 {
+			log.Printf("Waiting %s before reconnecting (%d/%d) to %s\n", delay.Round(time.Millisecond), attempt+1, m.config.MaxReconnect, m.config.NatsURL)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-m.quit:
+			log.Printf("Stopped reconnecting to %s\n", m.config.NatsURL)
+			return
+		}
+
+		m.emit(Event{
+			Type:        EventReconnecting,
+			Attempt:     attempt + 1,
+			MaxAttempts: m.config.MaxReconnect,
+			Err:         err,
+		})
+
+		err = m.dial(Event{
+			Type:        EventReconnected,
+			Attempt:     attempt + 1,
+			MaxAttempts: m.config.MaxReconnect,
+		})
+		if err == nil {
+			log.Printf("Reconnecting (%d/%d) to %s succeeded\n", attempt+1, m.config.MaxReconnect, m.config.NatsURL)
+			return
+		} else if errors.Is(err, ErrClosed) {
+			return
+		}
+
+		log.Printf("Reconnecting (%d/%d) to %s failed: %s\n", attempt+1, m.config.MaxReconnect, m.config.NatsURL, err)
+	}
+
+	log.Printf("Reconnecting limit (%d) reached for %s\n", m.config.MaxReconnect, m.config.NatsURL)
+
+	m.transition(StateFailed, Event{Type: EventGaveUp, MaxAttempts: m.config.MaxReconnect, Err: err}, func() bool {
+		return !m.isClosed()
+	})
+}
+
+// transition moves to state when update, which is called with the lock held,
+// returns true, then sends event. OnStateChange and the event's handlers are
+// called before any other transition, so that they see every change in
+// order, they must not call Close.
+func (m *Manager) transition(to State, event Event, update func() bool) bool {
+	m.notify.Lock()
+	defer m.notify.Unlock()
+
+	m.lock.Lock()
+	if !update() {
+		m.lock.Unlock()
+		return false
+	}
+
+	from := m.state
+	m.state = to
+	m.lock.Unlock()
+
+	if m.config.OnStateChange != nil && from != to {
+		m.config.OnStateChange(from, to)
+	}
+
+	event.State = to
+	m.config.Events.Emit(event)
+
+	return true
+}
+
+// emit sends an event which doesn't change the state.
+func (m *Manager) emit(event Event) {
+	m.notify.Lock()
+	defer m.notify.Unlock()
+
+	event.State = m.State()
+	m.config.Events.Emit(event)
+}
+
+func (m *Manager) isClosed() bool {
+	select {
+	case <-m.quit:
+		return true
+	default:
+		return false
+	}
+}
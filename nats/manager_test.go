@@ -0,0 +1,437 @@
+package nats
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	stan "github.com/nats-io/stan.go"
+)
+
+const testClusterID = "test-cluster"
+
+// runServer starts NATS Streaming on port, a random one when -1.
+func runServer(t *testing.T, port int) *stand.StanServer {
+	t.Helper()
+
+	opts := stand.GetDefaultOptions()
+	opts.ID = testClusterID
+
+	natsOpts := natsserver.Options{
+		Host:   "127.0.0.1",
+		Port:   port,
+		NoLog:  true,
+		NoSigs: true,
+	}
+
+	s, err := stand.RunServerWithOpts(opts, &natsOpts)
+	if err != nil {
+		t.Fatalf("unable to start NATS Streaming: %s", err)
+	}
+
+	return s
+}
+
+// testOptions lose the connection quickly when the server goes away.
+var testOptions = ConnectOptions{
+	ConnectTimeout: time.Second,
+	PingInterval:   time.Second,
+	PingMaxOut:     2,
+}
+
+// stateRecorder records the changes passed to OnStateChange.
+type stateRecorder struct {
+	lock    sync.Mutex
+	changes []State
+	ch      chan State
+}
+
+func newStateRecorder() *stateRecorder {
+	return &stateRecorder{ch: make(chan State, 16)}
+}
+
+func (r *stateRecorder) onStateChange(from, to State) {
+	r.lock.Lock()
+	r.changes = append(r.changes, to)
+	r.lock.Unlock()
+
+	r.ch <- to
+}
+
+func (r *stateRecorder) waitFor(t *testing.T, want State) {
+	t.Helper()
+
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case got := <-r.ch:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %s, changes: %v", want, r.states())
+		}
+	}
+}
+
+func (r *stateRecorder) states() []State {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]State{}, r.changes...)
+}
+
+// eventRecorder records the events sent by a Manager.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) record(e Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var types []EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+
+	return types
+}
+
+func (r *eventRecorder) last() Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.events[len(r.events)-1]
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second}
+
+	cases := map[int]time.Duration{
+		0: 0,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	}
+
+	for attempt, want := range cases {
+		if got := b.Delay(attempt); got != want {
+			t.Errorf("attempt %d: want %s, got %s", attempt, want, got)
+		}
+	}
+}
+
+func TestBackoffDelay_DefaultMax(t *testing.T) {
+	b := Backoff{Initial: time.Second}
+
+	if got := b.Delay(100); got != DefaultMaxBackoff {
+		t.Errorf("want %s, got %s", DefaultMaxBackoff, got)
+	}
+}
+
+func TestBackoffDelay_Jitter(t *testing.T) {
+	b := Backoff{Initial: 10 * time.Second, Jitter: 0.2}
+
+	for i := 0; i < 100; i++ {
+		got := b.Delay(1)
+		if got < 8*time.Second || got > 10*time.Second {
+			t.Fatalf("want between 8s and 10s, got %s", got)
+		}
+	}
+}
+
+func TestManager_Connect(t *testing.T) {
+	s := runServer(t, -1)
+	defer s.Shutdown()
+
+	recorder := newStateRecorder()
+
+	var connected stan.Conn
+	m := NewManager(ManagerConfig{
+		ClusterID: testClusterID,
+		ClientID:  "manager-connect",
+		NatsURL:   s.ClientURL(),
+		Options:   testOptions,
+		OnConnect: func(conn stan.Conn) error {
+			connected = conn
+			return nil
+		},
+		OnStateChange: recorder.onStateChange,
+	})
+
+	if got := m.State(); got != StateDisconnected {
+		t.Errorf("want %s before connecting, got %s", StateDisconnected, got)
+	}
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+
+	if m.State() != StateConnected || m.Conn() == nil || m.Conn() != connected {
+		t.Fatalf("want a connection passed to OnConnect, got state %s", m.State())
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("unable to close: %s", err)
+	}
+
+	if m.State() != StateClosed || m.Conn() != nil {
+		t.Errorf("want closed without a connection, got state %s", m.State())
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("want closing again to do nothing, got: %s", err)
+	}
+
+	want := []State{StateConnected, StateClosed}
+	if got := recorder.states(); !equalStates(got, want) {
+		t.Errorf("want changes %v, got %v", want, got)
+	}
+}
+
+func TestManager_ConnectFails(t *testing.T) {
+	m := NewManager(ManagerConfig{
+		ClusterID: testClusterID,
+		ClientID:  "manager-connect-fails",
+		NatsURL:   "nats://127.0.0.1:1",
+		Options:   testOptions,
+	})
+
+	if err := m.Connect(); err == nil {
+		t.Fatal("want an error without a server")
+	}
+
+	if got := m.State(); got != StateDisconnected {
+		t.Errorf("want %s, got %s", StateDisconnected, got)
+	}
+}
+
+func TestManager_OnConnectError(t *testing.T) {
+	s := runServer(t, -1)
+	defer s.Shutdown()
+
+	want := errors.New("subscribe failed")
+	m := NewManager(ManagerConfig{
+		ClusterID: testClusterID,
+		ClientID:  "manager-on-connect-error",
+		NatsURL:   s.ClientURL(),
+		Options:   testOptions,
+		OnConnect: func(conn stan.Conn) error {
+			return want
+		},
+	})
+
+	if err := m.Connect(); !errors.Is(err, want) {
+		t.Fatalf("want %s, got: %v", want, err)
+	}
+
+	if m.Conn() != nil || m.State() != StateDisconnected {
+		t.Errorf("want no connection, got state %s", m.State())
+	}
+}
+
+func TestManager_Reconnects(t *testing.T) {
+	s := runServer(t, -1)
+	natsURL := s.ClientURL()
+	port := serverPort(t, natsURL)
+
+	recorder := newStateRecorder()
+	events := &eventRecorder{}
+
+	var lock sync.Mutex
+	connects := 0
+	m := NewManager(ManagerConfig{
+		ClusterID:    testClusterID,
+		ClientID:     "manager-reconnects",
+		NatsURL:      natsURL,
+		Options:      testOptions,
+		MaxReconnect: 30,
+		Backoff:      Backoff{Initial: 100 * time.Millisecond, Max: 500 * time.Millisecond},
+		OnConnect: func(conn stan.Conn) error {
+			lock.Lock()
+			connects++
+			lock.Unlock()
+			return nil
+		},
+		OnStateChange: recorder.onStateChange,
+		Subscriptions: func() []string { return []string{"faas-request"} },
+	})
+	defer m.Close()
+
+	m.Events().Subscribe(events.record)
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	recorder.waitFor(t, StateConnected)
+
+	first := m.Conn()
+	s.Shutdown()
+
+	recorder.waitFor(t, StateReconnecting)
+
+	s = runServer(t, port)
+	defer s.Shutdown()
+
+	recorder.waitFor(t, StateConnected)
+
+	if m.Conn() == nil || m.Conn() == first {
+		t.Error("want a new connection")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if connects != 2 {
+		t.Errorf("want OnConnect called for each connection, got %d calls", connects)
+	}
+
+	types := events.types()
+	want := []EventType{EventConnected, EventDisconnected, EventSubscriptionLost, EventReconnecting}
+	if len(types) < len(want)+1 || !equalEventTypes(types[:len(want)], want) || types[len(types)-1] != EventReconnected {
+		t.Errorf("want %v then attempts until %s, got %v", want, EventReconnected, types)
+	}
+
+	reconnected := events.last()
+	if reconnected.State != StateConnected || reconnected.Attempt < 1 || reconnected.MaxAttempts != 30 {
+		t.Errorf("want the attempt which reconnected, got %+v", reconnected)
+	}
+
+	if m.Events().State() != StateConnected {
+		t.Errorf("want the events' state to follow the connection, got %s", m.Events().State())
+	}
+}
+
+func TestManager_GivesUp(t *testing.T) {
+	s := runServer(t, -1)
+
+	recorder := newStateRecorder()
+	events := &eventRecorder{}
+	m := NewManager(ManagerConfig{
+		ClusterID:     testClusterID,
+		ClientID:      "manager-gives-up",
+		NatsURL:       s.ClientURL(),
+		Options:       testOptions,
+		MaxReconnect:  2,
+		Backoff:       Backoff{Initial: 10 * time.Millisecond},
+		OnStateChange: recorder.onStateChange,
+	})
+	defer m.Close()
+
+	m.Events().Subscribe(events.record)
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+
+	s.Shutdown()
+
+	recorder.waitFor(t, StateFailed)
+
+	wantEvents := []EventType{EventConnected, EventDisconnected, EventReconnecting, EventReconnecting, EventGaveUp}
+	if got := events.types(); !equalEventTypes(got, wantEvents) {
+		t.Errorf("want events %v, got %v", wantEvents, got)
+	}
+
+	if gaveUp := events.last(); gaveUp.Err == nil || gaveUp.State != StateFailed {
+		t.Errorf("want the error from the last attempt, got %+v", gaveUp)
+	}
+
+	want := []State{StateConnected, StateReconnecting, StateFailed}
+	if got := recorder.states(); !equalStates(got, want) {
+		t.Errorf("want changes %v, got %v", want, got)
+	}
+
+	if m.Conn() != nil {
+		t.Error("want no connection after giving up")
+	}
+}
+
+func TestManager_CloseStopsReconnecting(t *testing.T) {
+	s := runServer(t, -1)
+
+	recorder := newStateRecorder()
+	m := NewManager(ManagerConfig{
+		ClusterID:     testClusterID,
+		ClientID:      "manager-close",
+		NatsURL:       s.ClientURL(),
+		Options:       testOptions,
+		MaxReconnect:  100,
+		Backoff:       Backoff{Initial: time.Minute},
+		OnStateChange: recorder.onStateChange,
+	})
+
+	if err := m.Connect(); err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+
+	s.Shutdown()
+	recorder.waitFor(t, StateReconnecting)
+
+	if err := m.Close(); err != nil {
+		t.Errorf("unable to close: %s", err)
+	}
+
+	if got := m.State(); got != StateClosed {
+		t.Errorf("want %s, got %s", StateClosed, got)
+	}
+}
+
+func equalStates(a, b []State) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalEventTypes(a, b []EventType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func serverPort(t *testing.T, natsURL string) int {
+	t.Helper()
+
+	u, err := url.Parse(natsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+	"github.com/openfaas/nats-queue-worker/nats"
 )
 
 // ReadConfig constitutes config from env variables
@@ -16,22 +21,53 @@ const DefaultMaxReconnect = 120
 
 const DefaultReconnectDelay = time.Second * 2
 
+const DefaultNamespace = "openfaas-fn"
+
+const DefaultHTTPPort = 8081
+
+const DefaultCallbackMaxRedirects = 10
+
+const DefaultResultTTL = time.Minute * 10
+
+const DefaultResultMaxBytes = 64 * 1024 * 1024
+
+const DefaultStatusTTL = time.Hour
+
+const DefaultStatusMaxBytes = 16 * 1024 * 1024
+
+// DefaultFunctionURLTemplate resolves a function to its service within the
+// cluster when direct_functions is enabled.
+const DefaultFunctionURLTemplate = "{name}.{namespace}{suffix}:8080"
+
+// Read builds the config from env variables, and from the file given in the
+// config_file env variable. Env variables take precedence over the file.
+// Every problem found is reported in the error, along with the config built
+// from the valid settings and defaults.
 func (ReadConfig) Read() (QueueWorkerConfig, error) {
+	lookup, file, err := configLookup()
+	if err != nil {
+		return QueueWorkerConfig{}, err
+	}
+
+	errs := configErrors{}
+
 	cfg := QueueWorkerConfig{
 		AckWait:     time.Second * 30,
 		MaxInflight: 1,
 	}
 
-	if val, exists := os.LookupEnv("faas_nats_address"); exists {
+	cfg.ConfigFile, _ = os.LookupEnv("config_file")
+
+	if val, exists := lookup("faas_nats_address"); exists {
 		cfg.NatsAddress = val
 	} else {
 		cfg.NatsAddress = "nats"
 	}
 
-	if value, exists := os.LookupEnv("faas_nats_port"); exists {
+	if value, exists := lookup("faas_nats_port"); exists {
 		val, err := strconv.Atoi(value)
 		if err != nil {
-			log.Println("converting faas_nats_port to int error:", err)
+			errs.add("converting faas_nats_port %s to int error: %s", value, err)
 		} else {
 			cfg.NatsPort = val
 		}
@@ -39,37 +75,208 @@ func (ReadConfig) Read() (QueueWorkerConfig, error) {
 		cfg.NatsPort = 4222
 	}
 
-	if val, exists := os.LookupEnv("faas_nats_cluster_name"); exists {
+	if val, exists := lookup("faas_nats_cluster_name"); exists {
 		cfg.NatsClusterName = val
 	} else {
 		cfg.NatsClusterName = "faas-cluster"
 	}
 
-	if val, exists := os.LookupEnv("faas_nats_queue_group"); exists && val != "" {
+	if val, exists := lookup("faas_nats_queue_group"); exists && val != "" {
 		cfg.NatsQueueGroup = val
 	} else {
 		cfg.NatsQueueGroup = "faas"
 	}
 
-	if val, exists := os.LookupEnv("faas_gateway_address"); exists {
+	if val, exists := lookup("faas_nats_servers"); exists {
+		cfg.NatsOptions.Servers = parseList(val)
+	}
+
+	if value, exists := lookup("faas_nats_connect_timeout"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse faas_nats_connect_timeout %s as time.Duration error: %s", value, err)
+		} else {
+			cfg.NatsOptions.ConnectTimeout = val
+		}
+	}
+
+	if value, exists := lookup("faas_nats_ping_interval"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse faas_nats_ping_interval %s as time.Duration error: %s", value, err)
+		} else if val < time.Second {
+			errs.add("faas_nats_ping_interval must be at least 1s, got: %s", value)
+		} else {
+			cfg.NatsOptions.PingInterval = val
+		}
+	}
+
+	if value, exists := lookup("faas_nats_ping_max_out"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting faas_nats_ping_max_out %s to int error: %s", value, err)
+		} else {
+			cfg.NatsOptions.PingMaxOut = val
+		}
+	}
+
+	if value, exists := lookup("faas_nats_pub_ack_wait"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse faas_nats_pub_ack_wait %s as time.Duration error: %s", value, err)
+		} else {
+			cfg.NatsOptions.PubAckWait = val
+		}
+	}
+
+	if value, exists := lookup("faas_nats_max_pub_acks_inflight"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting faas_nats_max_pub_acks_inflight %s to int error: %s", value, err)
+		} else {
+			cfg.NatsOptions.MaxPubAcksInflight = val
+		}
+	}
+
+	if val, exists := lookup("faas_nats_client_id"); exists {
+		cfg.NatsClientID = val
+	}
+
+	if val, exists := lookup("faas_nats_client_id_strategy"); exists {
+		strategy, err := nats.ParseClientIDStrategy(val)
+		if err != nil {
+			errs.add("faas_nats_client_id_strategy: %s", err)
+		} else {
+			cfg.NatsClientIDStrategy = strategy
+		}
+	} else {
+		cfg.NatsClientIDStrategy = nats.ClientIDHostname
+	}
+
+	if val, exists := lookup("faas_gateway_address"); exists {
 		cfg.GatewayAddress = val
 	} else {
 		cfg.GatewayAddress = "gateway"
 	}
 
-	if value, exists := os.LookupEnv("faas_gateway_port"); exists {
+	if value, exists := lookup("faas_gateway_port"); exists {
 		val, err := strconv.Atoi(value)
 		if err != nil {
-			return QueueWorkerConfig{}, fmt.Errorf("converting faas_gateway_port %s to int error: %s", value, err)
+			errs.add("converting faas_gateway_port %s to int error: %s", value, err)
+		} else {
+			cfg.GatewayPort = val
 		}
+	} else {
+		cfg.GatewayPort = 8080
+	}
 
-		cfg.GatewayPort = val
+	if val, exists := lookup("direct_functions"); exists {
+		if val == "1" || val == "true" {
+			cfg.DirectFunctions = true
+		} else {
+			cfg.DirectFunctions = false
+		}
+	}
 
+	if val, exists := lookup("gateway_health_check"); exists {
+		if val == "1" || val == "true" {
+			cfg.GatewayHealthCheck = true
+		} else {
+			cfg.GatewayHealthCheck = false
+		}
+	}
+
+	if val, exists := lookup("gateway_health_path"); exists && val != "" {
+		cfg.GatewayHealthPath = "/" + strings.TrimPrefix(val, "/")
 	} else {
-		cfg.GatewayPort = 8080
+		cfg.GatewayHealthPath = DefaultGatewayHealthPath
+	}
+
+	cfg.GatewayHealthInterval = DefaultGatewayHealthInterval
+
+	if value, exists := lookup("gateway_health_interval"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse gateway_health_interval %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("gateway_health_interval must be greater than zero, got: %s", value)
+		} else {
+			cfg.GatewayHealthInterval = val
+		}
+	}
+
+	cfg.GatewayFailureThreshold = DefaultGatewayFailureThreshold
+
+	if value, exists := lookup("gateway_failure_threshold"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting gateway_failure_threshold %s to int error: %s", value, err)
+		} else if val < 1 {
+			errs.add("gateway_failure_threshold must be at least 1, got: %d", val)
+		} else {
+			cfg.GatewayFailureThreshold = val
+		}
 	}
 
-	if val, exists := os.LookupEnv("faas_print_body"); exists {
+	if value, exists := lookup("cold_start_wait"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse cold_start_wait %s as time.Duration error: %s", value, err)
+		} else {
+			cfg.ColdStartWait = val
+		}
+	}
+
+	cfg.ColdStartPollInterval = DefaultColdStartPollInterval
+
+	if value, exists := lookup("cold_start_poll_interval"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse cold_start_poll_interval %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("cold_start_poll_interval must be greater than zero, got: %s", value)
+		} else {
+			cfg.ColdStartPollInterval = val
+		}
+	}
+
+	if val, exists := lookup("basic_auth"); exists {
+		if val == "1" || val == "true" {
+			cfg.BasicAuth = true
+		} else {
+			cfg.BasicAuth = false
+		}
+	}
+
+	if val, exists := lookup("secret_mount_path"); exists && val != "" {
+		cfg.SecretMountPath = val
+	} else {
+		cfg.SecretMountPath = DefaultSecretMountPath
+	}
+
+	if val, exists := lookup("direct_functions_suffix"); exists {
+		cfg.FunctionSuffix = val
+	}
+
+	if val, exists := lookup("function_url_template"); exists && val != "" {
+		cfg.FunctionURLTemplate = val
+	} else {
+		cfg.FunctionURLTemplate = DefaultFunctionURLTemplate
+	}
+
+	if val, exists := lookup("default_function_namespace"); exists && val != "" {
+		cfg.DefaultNamespace = val
+	} else {
+		cfg.DefaultNamespace = DefaultNamespace
+	}
+
+	if val, exists := lookup("allowed_namespaces"); exists {
+		cfg.AllowedNamespaces = parseList(val)
+	}
+
+	cfg.Namespaces = readNamespaces(lookup, &errs)
+
+	if val, exists := lookup("faas_print_body"); exists {
 		if val == "1" || val == "true" {
 			cfg.DebugPrintBody = true
 		} else {
@@ -77,7 +284,7 @@ func (ReadConfig) Read() (QueueWorkerConfig, error) {
 		}
 	}
 
-	if val, exists := os.LookupEnv("write_debug"); exists {
+	if val, exists := lookup("write_debug"); exists {
 		if val == "1" || val == "true" {
 			cfg.WriteDebug = true
 		} else {
@@ -87,11 +294,11 @@ func (ReadConfig) Read() (QueueWorkerConfig, error) {
 
 	cfg.MaxReconnect = DefaultMaxReconnect
 
-	if value, exists := os.LookupEnv("faas_max_reconnect"); exists {
+	if value, exists := lookup("faas_max_reconnect"); exists {
 		val, err := strconv.Atoi(value)
 
 		if err != nil {
-			log.Println("converting faas_max_reconnect to int error:", err)
+			errs.add("converting faas_max_reconnect %s to int error: %s", value, err)
 		} else {
 			cfg.MaxReconnect = val
 		}
@@ -99,27 +306,427 @@ func (ReadConfig) Read() (QueueWorkerConfig, error) {
 
 	cfg.ReconnectDelay = DefaultReconnectDelay
 
-	if value, exists := os.LookupEnv("faas_reconnect_delay"); exists {
+	if value, exists := lookup("faas_reconnect_delay"); exists {
 		reconnectDelayVal, durationErr := time.ParseDuration(value)
 
 		if durationErr != nil {
-			log.Println("parse env var: faas_reconnect_delay as time.Duration error:", durationErr)
-
+			errs.add("parse faas_reconnect_delay %s as time.Duration error: %s", value, durationErr)
 		} else {
 			cfg.ReconnectDelay = reconnectDelayVal
 		}
 	}
 
-	if val, exists := os.LookupEnv("ack_wait"); exists {
+	if value, exists := lookup("max_inflight"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting max_inflight %s to int error: %s", value, err)
+		} else if val < 1 {
+			errs.add("max_inflight must be at least 1, got: %d", val)
+		} else {
+			cfg.MaxInflight = val
+		}
+	}
+
+	if val, exists := lookup("durable_name"); exists {
+		cfg.DurableName = val
+	}
+
+	if value, exists := lookup("start_position"); exists {
+		val, err := parseStartPosition(value)
+		if err != nil {
+			errs.add("start_position error: %s", err)
+		} else {
+			cfg.StartPosition = val
+		}
+	}
+
+	if val, exists := lookup("unsubscribe_on_close"); exists {
+		if val == "1" || val == "true" {
+			cfg.UnsubscribeOnClose = true
+		} else {
+			cfg.UnsubscribeOnClose = false
+		}
+	}
+
+	if val, exists := lookup("ack_wait"); exists {
 		ackWaitVal, durationErr := time.ParseDuration(val)
 		if durationErr != nil {
-			log.Println("ack_wait error:", durationErr)
+			errs.add("parse ack_wait %s as time.Duration error: %s", val, durationErr)
+		} else if ackWaitVal <= 0 {
+			errs.add("ack_wait must be greater than zero, got: %s", val)
 		} else {
 			cfg.AckWait = ackWaitVal
 		}
 	}
 
-	return cfg, nil
+	if value, exists := lookup("max_response_size"); exists {
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.add("converting max_response_size %s to int error: %s", value, err)
+		} else if val < 0 {
+			errs.add("max_response_size must not be negative, got: %s", value)
+		} else {
+			cfg.MaxResponseSize = val
+		}
+	}
+
+	if val, exists := lookup("stream_response"); exists {
+		if val == "1" || val == "true" {
+			cfg.StreamResponse = true
+		} else {
+			cfg.StreamResponse = false
+		}
+	}
+
+	cfg.CallbackPolicy = readCallbackPolicy(lookup, &errs)
+	cfg.CircuitBreaker = readCircuitBreaker(lookup, &errs)
+
+	if val, exists := lookup("adaptive_concurrency"); exists {
+		if val == "1" || val == "true" {
+			cfg.AdaptiveConcurrency.Enabled = true
+		} else {
+			cfg.AdaptiveConcurrency.Enabled = false
+		}
+	}
+
+	cfg.AdaptiveConcurrency.MinInflight = 1
+
+	if value, exists := lookup("adaptive_min_inflight"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting adaptive_min_inflight %s to int error: %s", value, err)
+		} else if val < 1 || val > cfg.MaxInflight {
+			errs.add("adaptive_min_inflight must be between 1 and max_inflight (%d), got: %d", cfg.MaxInflight, val)
+		} else {
+			cfg.AdaptiveConcurrency.MinInflight = val
+		}
+	}
+
+	if value, exists := lookup("adaptive_latency_target"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse adaptive_latency_target %s as time.Duration error: %s", value, err)
+		} else {
+			cfg.AdaptiveConcurrency.LatencyTarget = val
+		}
+	}
+
+	if val, exists := lookup("result_store"); exists {
+		cfg.ResultStore = val
+	}
+
+	cfg.ResultTTL = DefaultResultTTL
+
+	if value, exists := lookup("result_ttl"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse result_ttl %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("result_ttl must be greater than zero, got: %s", value)
+		} else {
+			cfg.ResultTTL = val
+		}
+	}
+
+	cfg.ResultMaxBytes = DefaultResultMaxBytes
+
+	if value, exists := lookup("result_max_bytes"); exists {
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.add("converting result_max_bytes %s to int error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("result_max_bytes must be greater than zero, got: %s", value)
+		} else {
+			cfg.ResultMaxBytes = val
+		}
+	}
+
+	if val, exists := lookup("track_status"); exists {
+		if val == "1" || val == "true" {
+			cfg.TrackStatus = true
+		} else {
+			cfg.TrackStatus = false
+		}
+	}
+
+	if val, exists := lookup("status_subject"); exists && val != "" {
+		cfg.StatusSubject = val
+	} else {
+		cfg.StatusSubject = lifecycle.DefaultSubject
+	}
+
+	cfg.StatusTTL = DefaultStatusTTL
+
+	if value, exists := lookup("status_ttl"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse status_ttl %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("status_ttl must be greater than zero, got: %s", value)
+		} else {
+			cfg.StatusTTL = val
+		}
+	}
+
+	cfg.StatusMaxBytes = DefaultStatusMaxBytes
+
+	if value, exists := lookup("status_max_bytes"); exists {
+		val, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.add("converting status_max_bytes %s to int error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("status_max_bytes must be greater than zero, got: %s", value)
+		} else {
+			cfg.StatusMaxBytes = val
+		}
+	}
+
+	if value, exists := lookup("message_ttl"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse message_ttl %s as time.Duration error: %s", value, err)
+		} else {
+			cfg.MessageTTL = val
+		}
+	}
+
+	if val, exists := lookup("admin_token"); exists {
+		cfg.AdminToken = val
+	}
+
+	cfg.HTTPPort = DefaultHTTPPort
+
+	if value, exists := lookup("http_port"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting http_port %s to int error: %s", value, err)
+		} else {
+			cfg.HTTPPort = val
+		}
+	}
+
+	cfg.CallbackPolicy.ReservedSubjects = cfg.reservedSubjects()
+
+	if file != nil {
+		cfg.Functions = readFunctions(file.functions, &errs)
+
+		for _, name := range file.unused() {
+			errs.add("config_file %s: unknown setting %q", cfg.ConfigFile, name)
+		}
+	}
+
+	return cfg, errs.err()
+}
+
+// configErrors collects every problem found in the config, so that they can
+// all be fixed at once.
+type configErrors []error
+
+func (e *configErrors) add(format string, a ...interface{}) {
+	*e = append(*e, fmt.Errorf(format, a...))
+}
+
+func (e configErrors) err() error {
+	return errors.Join(e...)
+}
+
+// readCallbackPolicy reads the restrictions on where results can be posted.
+func readCallbackPolicy(lookup lookupFunc, errs *configErrors) CallbackPolicy {
+	policy := CallbackPolicy{
+		AllowedSchemes: []string{"http", "https"},
+		MaxRedirects:   DefaultCallbackMaxRedirects,
+	}
+
+	if val, exists := lookup("callback_allowed_schemes"); exists {
+		policy.AllowedSchemes = parseList(strings.ToLower(val))
+	}
+
+	if val, exists := lookup("callback_allowed_hosts"); exists {
+		policy.AllowedHosts = parseList(val)
+	}
+
+	if val, exists := lookup("callback_denied_hosts"); exists {
+		policy.DeniedHosts = parseList(val)
+	}
+
+	if val, exists := lookup("callback_allowed_cidrs"); exists {
+		cidrs, err := parseCIDRs(parseList(val))
+		if err != nil {
+			errs.add("callback_allowed_cidrs error: %s", err)
+		} else {
+			policy.AllowedCIDRs = cidrs
+		}
+	}
+
+	if val, exists := lookup("callback_denied_cidrs"); exists {
+		cidrs, err := parseCIDRs(parseList(val))
+		if err != nil {
+			errs.add("callback_denied_cidrs error: %s", err)
+		} else {
+			policy.DeniedCIDRs = cidrs
+		}
+	}
+
+	if val, exists := lookup("callback_block_private"); exists {
+		if val == "1" || val == "true" {
+			policy.BlockPrivate = true
+		} else {
+			policy.BlockPrivate = false
+		}
+	}
+
+	if val, exists := lookup("callback_allowed_subjects"); exists {
+		policy.AllowedSubjects = parseList(val)
+	}
+
+	if value, exists := lookup("callback_max_redirects"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting callback_max_redirects %s to int error: %s", value, err)
+		} else {
+			policy.MaxRedirects = val
+		}
+	}
+
+	return policy
+}
+
+// readCircuitBreaker reads when each function's circuit opens.
+func readCircuitBreaker(lookup lookupFunc, errs *configErrors) CircuitBreakerConfig {
+	config := CircuitBreakerConfig{
+		FailureThreshold: DefaultCircuitFailureThreshold,
+		FailureRate:      DefaultCircuitFailureRate,
+		MinRequests:      DefaultCircuitMinRequests,
+		Window:           DefaultCircuitWindow,
+		OpenDuration:     DefaultCircuitOpenDuration,
+	}
+
+	if val, exists := lookup("circuit_breaker"); exists {
+		if val == "1" || val == "true" {
+			config.Enabled = true
+		} else {
+			config.Enabled = false
+		}
+	}
+
+	if value, exists := lookup("circuit_failure_threshold"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting circuit_failure_threshold %s to int error: %s", value, err)
+		} else if val < 1 {
+			errs.add("circuit_failure_threshold must be at least 1, got: %d", val)
+		} else {
+			config.FailureThreshold = val
+		}
+	}
+
+	if value, exists := lookup("circuit_failure_rate"); exists {
+		val, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs.add("converting circuit_failure_rate %s to float error: %s", value, err)
+		} else if val <= 0 || val > 1 {
+			errs.add("circuit_failure_rate must be greater than 0 and at most 1, got: %s", value)
+		} else {
+			config.FailureRate = val
+		}
+	}
+
+	if value, exists := lookup("circuit_min_requests"); exists {
+		val, err := strconv.Atoi(value)
+		if err != nil {
+			errs.add("converting circuit_min_requests %s to int error: %s", value, err)
+		} else if val < 1 {
+			errs.add("circuit_min_requests must be at least 1, got: %d", val)
+		} else {
+			config.MinRequests = val
+		}
+	}
+
+	if value, exists := lookup("circuit_window"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse circuit_window %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("circuit_window must be greater than zero, got: %s", value)
+		} else {
+			config.Window = val
+		}
+	}
+
+	if value, exists := lookup("circuit_open_duration"); exists {
+		val, err := time.ParseDuration(value)
+		if err != nil {
+			errs.add("parse circuit_open_duration %s as time.Duration error: %s", value, err)
+		} else if val <= 0 {
+			errs.add("circuit_open_duration must be greater than zero, got: %s", value)
+		} else {
+			config.OpenDuration = val
+		}
+	}
+
+	if val, exists := lookup("circuit_holding_channel"); exists {
+		if val == sharedQueue {
+			errs.add("circuit_holding_channel can't be the queue itself: %s", val)
+		} else {
+			config.HoldingChannel = val
+		}
+	}
+
+	return config
+}
+
+// readNamespaces reads the per-namespace settings given as lists of
+// namespace=value pairs.
+func readNamespaces(lookup lookupFunc, errs *configErrors) map[string]NamespaceConfig {
+	namespaces := map[string]NamespaceConfig{}
+
+	if value, exists := lookup("namespace_max_inflight"); exists {
+		values, err := parseNamespaceValues(value)
+		if err != nil {
+			errs.add("namespace_max_inflight error: %s", err)
+		}
+
+		for namespace, v := range values {
+			val, err := strconv.Atoi(v)
+			if err != nil {
+				errs.add("converting namespace_max_inflight %s for %s to int error: %s", v, namespace, err)
+				continue
+			}
+
+			settings := namespaces[namespace]
+			settings.MaxInflight = val
+			namespaces[namespace] = settings
+		}
+	}
+
+	if value, exists := lookup("namespace_timeout"); exists {
+		values, err := parseNamespaceValues(value)
+		if err != nil {
+			errs.add("namespace_timeout error: %s", err)
+		}
+
+		for namespace, v := range values {
+			val, err := time.ParseDuration(v)
+			if err != nil {
+				errs.add("parse namespace_timeout %s for %s as time.Duration error: %s", v, namespace, err)
+				continue
+			}
+
+			settings := namespaces[namespace]
+			settings.Timeout = val
+			namespaces[namespace] = settings
+		}
+	}
+
+	if value, exists := lookup("namespace_disable_callbacks"); exists {
+		for _, namespace := range parseList(value) {
+			settings := namespaces[namespace]
+			settings.DisableCallbacks = true
+			namespaces[namespace] = settings
+		}
+	}
+
+	return namespaces
 }
 
 type QueueWorkerConfig struct {
@@ -128,18 +735,218 @@ type QueueWorkerConfig struct {
 	NatsClusterName string
 	NatsQueueGroup  string
 
+	// NatsOptions tune the connection to NATS Streaming.
+	NatsOptions nats.ConnectOptions
+
+	// NatsClientID is used as the client ID when set, otherwise it is
+	// built from the hostname with NatsClientIDStrategy.
+	NatsClientID         string
+	NatsClientIDStrategy nats.ClientIDStrategy
+
 	GatewayAddress string
-	FunctionSuffix string
 	GatewayPort    int
+
+	// GatewayHealthCheck pauses consuming from the queue whilst the
+	// gateway is unhealthy.
+	GatewayHealthCheck bool
+
+	// GatewayHealthPath is probed on the gateway to find out when it has
+	// recovered.
+	GatewayHealthPath string
+
+	// GatewayHealthInterval is how often the gateway is probed.
+	GatewayHealthInterval time.Duration
+
+	// GatewayFailureThreshold is the number of consecutive invocations
+	// which fail to reach the gateway before it is unhealthy.
+	GatewayFailureThreshold int
+
+	// ColdStartWait is the longest an invocation waits for a function
+	// which was scaled to zero to become ready, zero means cold starts are
+	// not waited for.
+	ColdStartWait time.Duration
+
+	// ColdStartPollInterval is how often the gateway is asked whether the
+	// function is ready.
+	ColdStartPollInterval time.Duration
+
+	// BasicAuth sends the credentials from SecretMountPath to the gateway's
+	// API.
+	BasicAuth       bool
+	SecretMountPath string
+
+	// DirectFunctions invokes functions via their service address,
+	// bypassing the gateway.
+	DirectFunctions bool
+
+	// FunctionSuffix is appended to the function's address in
+	// direct mode, i.e. svc.cluster.local
+	FunctionSuffix string
+
+	// FunctionURLTemplate resolves a function's address in direct mode,
+	// {name}, {namespace} and {suffix} are substituted.
+	FunctionURLTemplate string
+
+	// DefaultNamespace is used for functions queued without a namespace.
+	DefaultNamespace string
+
+	// AllowedNamespaces restricts invocations to these namespaces, when
+	// empty all namespaces are allowed.
+	AllowedNamespaces []string
+
+	// Namespaces holds settings for individual namespaces.
+	Namespaces map[string]NamespaceConfig
+
+	// CallbackPolicy restricts where results can be posted.
+	CallbackPolicy CallbackPolicy
+
+	// AdaptiveConcurrency adjusts the number of concurrent invocations up
+	// to MaxInflight.
+	AdaptiveConcurrency AdaptiveConcurrencyConfig
+
+	// CircuitBreaker stops invoking functions which keep failing.
+	CircuitBreaker CircuitBreakerConfig
+
+	// ResultStore keeps results to be fetched from /results/{callId},
+	// "memory" is supported. Results are not stored when empty.
+	ResultStore string
+
+	// ResultTTL is how long stored results are kept for.
+	ResultTTL time.Duration
+
+	// ResultMaxBytes limits the results kept in memory, the oldest are
+	// evicted first.
+	ResultMaxBytes int64
+
+	// TrackStatus records the lifecycle of invocations to be queried from
+	// /status/{callId}.
+	TrackStatus bool
+
+	// StatusSubject is the NATS subject lifecycle events are exchanged on.
+	StatusSubject string
+
+	// StatusTTL is how long the lifecycle of an invocation is kept for.
+	StatusTTL time.Duration
+
+	// StatusMaxBytes limits the lifecycle events kept in memory, the
+	// invocations which changed least recently are evicted first.
+	StatusMaxBytes int64
+
+	// MessageTTL expires messages which were queued for longer, zero
+	// means messages never expire.
+	MessageTTL time.Duration
+
+	// Functions holds settings for individual functions from the
+	// config_file, by name or name.namespace.
+	Functions map[string]FunctionConfig
+
+	// ConfigFile is read for settings not given as env variables, and is
+	// watched for changes.
+	ConfigFile string
+
+	// AdminToken enables the admin API on HTTPPort, requests must give it
+	// as a bearer token.
+	AdminToken string `json:"-"`
+
+	// HTTPPort serves the worker's HTTP endpoints such as /metrics.
+	HTTPPort int
+
+	// DurableName of the subscription, derived from the channel when
+	// empty. Worker pools with different names each receive every message.
+	DurableName string
+
+	// StartPosition is where a new durable starts reading the channel.
+	StartPosition StartPosition
+
+	// UnsubscribeOnClose removes the durable on shutdown, so that the next
+	// start begins from StartPosition, rather than only closing it.
+	UnsubscribeOnClose bool
+
 	MaxInflight    int
 	MaxReconnect   int
 	AckWait        time.Duration
 	ReconnectDelay time.Duration
 
+	// MaxResponseSize is the maximum number of bytes read from a
+	// function's response, anything beyond it is dropped. Zero means
+	// no limit.
+	MaxResponseSize int64
+
+	// StreamResponse pipes the function's response to the callback
+	// instead of buffering it in memory first.
+	StreamResponse bool
+
 	DebugPrintBody bool
 	WriteDebug     bool
 }
 
+// reservedSubjects returns the subjects and channels the worker uses, which
+// results can't be published to.
+func (q QueueWorkerConfig) reservedSubjects() []string {
+	subjects := []string{sharedQueue}
+
+	if len(q.StatusSubject) > 0 {
+		subjects = append(subjects, q.StatusSubject)
+	}
+
+	if len(q.CircuitBreaker.HoldingChannel) > 0 {
+		subjects = append(subjects, q.CircuitBreaker.HoldingChannel)
+	}
+
+	return subjects
+}
+
 func (q QueueWorkerConfig) GatewayAddressURL() string {
 	return fmt.Sprintf("%s:%d", q.GatewayAddress, q.GatewayPort)
 }
+
+// FunctionAddress resolves a function's address for direct invocation using
+// FunctionURLTemplate.
+func (q QueueWorkerConfig) FunctionAddress(name, namespace string) string {
+	tmpl := q.FunctionURLTemplate
+	if len(tmpl) == 0 {
+		tmpl = DefaultFunctionURLTemplate
+	}
+
+	suffix := ""
+	if s := strings.Trim(q.FunctionSuffix, "."); len(s) > 0 {
+		suffix = "." + s
+	}
+
+	return strings.NewReplacer(
+		"{name}", name,
+		"{namespace}", namespace,
+		"{suffix}", suffix,
+	).Replace(tmpl)
+}
+
+// Redacted returns a copy of the config which is safe to log, secrets are
+// replaced and credentials are removed from callback URLs.
+func (q QueueWorkerConfig) Redacted() QueueWorkerConfig {
+	if len(q.AdminToken) > 0 {
+		q.AdminToken = "[redacted]"
+	}
+
+	functions := make(map[string]FunctionConfig, len(q.Functions))
+	for name, function := range q.Functions {
+		if function.CallbackURL != nil && function.CallbackURL.User != nil {
+			u := *function.CallbackURL
+			u.User = url.User("[redacted]")
+			function.CallbackURL = &u
+		}
+		functions[name] = function
+	}
+	q.Functions = functions
+
+	servers := make([]string, len(q.NatsOptions.Servers))
+	for i, server := range q.NatsOptions.Servers {
+		if u, err := url.Parse(server); err == nil && u.User != nil {
+			u.User = url.User("[redacted]")
+			server = u.String()
+		}
+		servers[i] = server
+	}
+	q.NatsOptions.Servers = servers
+
+	return q
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sync"
+)
+
+// reloader applies a new config to a running worker on SIGHUP or when the
+// config_file changes.
+type reloader struct {
+	readConfig ReadConfig
+	worker     *worker
+	queue      *NATSQueue
+
+	mutex sync.Mutex
+}
+
+// reload reads the config again and applies what it can: the concurrency and
+// ack wait of the subscription, timeouts, debug logging, namespace settings
+// and the callback policy. Settings which need a restart keep their current
+// values. An invalid config is logged and the current config is kept.
+func (r *reloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	next, err := r.readConfig.Read()
+	if err != nil {
+		log.Printf("Unable to reload config, keeping the current config: %s", err)
+		return
+	}
+
+	config, changed := keepRestartSettings(r.worker.Config(), next)
+	for _, name := range changed {
+		log.Printf("Reload: %s changed, a restart is required to apply it", name)
+	}
+
+	callbackClient := makeCallbackClient(config.CallbackPolicy)
+	r.worker.Reload(config, &callbackClient)
+
+	if err := r.queue.reconfigure(config.MaxInflight, config.AckWait); err != nil {
+		log.Printf("Unable to reconfigure subscription: %s", err)
+		return
+	}
+
+	log.Printf("Reloaded config. Concurrency: %d\tAck wait: %s", config.MaxInflight, config.AckWait)
+}
+
+// keepRestartSettings returns next with the settings which can't be changed
+// without a restart set back to their current values, and the names of those
+// which differed.
+func keepRestartSettings(current, next QueueWorkerConfig) (QueueWorkerConfig, []string) {
+	var changed []string
+
+	keepString := func(name string, current string, next *string) {
+		if current != *next {
+			changed = append(changed, name)
+			*next = current
+		}
+	}
+
+	keepInt := func(name string, current int, next *int) {
+		if current != *next {
+			changed = append(changed, name)
+			*next = current
+		}
+	}
+
+	keepString("faas_nats_address", current.NatsAddress, &next.NatsAddress)
+	keepInt("faas_nats_port", current.NatsPort, &next.NatsPort)
+	keepString("faas_nats_cluster_name", current.NatsClusterName, &next.NatsClusterName)
+	keepString("faas_nats_queue_group", current.NatsQueueGroup, &next.NatsQueueGroup)
+	keepInt("faas_max_reconnect", current.MaxReconnect, &next.MaxReconnect)
+	keepInt("http_port", current.HTTPPort, &next.HTTPPort)
+	keepString("result_store", current.ResultStore, &next.ResultStore)
+	keepString("status_subject", current.StatusSubject, &next.StatusSubject)
+	keepString("admin_token", current.AdminToken, &next.AdminToken)
+	keepString("config_file", current.ConfigFile, &next.ConfigFile)
+	keepString("durable_name", current.DurableName, &next.DurableName)
+
+	if current.ReconnectDelay != next.ReconnectDelay {
+		changed = append(changed, "faas_reconnect_delay")
+		next.ReconnectDelay = current.ReconnectDelay
+	}
+
+	if current.ResultTTL != next.ResultTTL {
+		changed = append(changed, "result_ttl")
+		next.ResultTTL = current.ResultTTL
+	}
+
+	if current.ResultMaxBytes != next.ResultMaxBytes {
+		changed = append(changed, "result_max_bytes")
+		next.ResultMaxBytes = current.ResultMaxBytes
+	}
+
+	if current.TrackStatus != next.TrackStatus {
+		changed = append(changed, "track_status")
+		next.TrackStatus = current.TrackStatus
+	}
+
+	if current.GatewayHealthCheck != next.GatewayHealthCheck {
+		changed = append(changed, "gateway_health_check")
+		next.GatewayHealthCheck = current.GatewayHealthCheck
+	}
+
+	keepString("gateway_health_path", current.GatewayHealthPath, &next.GatewayHealthPath)
+	keepInt("gateway_failure_threshold", current.GatewayFailureThreshold, &next.GatewayFailureThreshold)
+
+	if current.GatewayHealthInterval != next.GatewayHealthInterval {
+		changed = append(changed, "gateway_health_interval")
+		next.GatewayHealthInterval = current.GatewayHealthInterval
+	}
+
+	if current.AdaptiveConcurrency.Enabled != next.AdaptiveConcurrency.Enabled {
+		changed = append(changed, "adaptive_concurrency")
+		next.AdaptiveConcurrency.Enabled = current.AdaptiveConcurrency.Enabled
+	}
+
+	if current.StartPosition != next.StartPosition {
+		changed = append(changed, "start_position")
+		next.StartPosition = current.StartPosition
+	}
+
+	if current.UnsubscribeOnClose != next.UnsubscribeOnClose {
+		changed = append(changed, "unsubscribe_on_close")
+		next.UnsubscribeOnClose = current.UnsubscribeOnClose
+	}
+
+	keepString("faas_nats_client_id", current.NatsClientID, &next.NatsClientID)
+
+	if current.NatsClientIDStrategy != next.NatsClientIDStrategy {
+		changed = append(changed, "faas_nats_client_id_strategy")
+		next.NatsClientIDStrategy = current.NatsClientIDStrategy
+	}
+
+	if !reflect.DeepEqual(current.NatsOptions, next.NatsOptions) {
+		changed = append(changed, "NATS connection options")
+		next.NatsOptions = current.NatsOptions
+	}
+
+	if current.StatusTTL != next.StatusTTL {
+		changed = append(changed, "status_ttl")
+		next.StatusTTL = current.StatusTTL
+	}
+
+	if current.StatusMaxBytes != next.StatusMaxBytes {
+		changed = append(changed, "status_max_bytes")
+		next.StatusMaxBytes = current.StatusMaxBytes
+	}
+
+	return next, changed
+}
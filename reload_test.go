@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_keepRestartSettings(t *testing.T) {
+	current := QueueWorkerConfig{
+		NatsAddress: "nats",
+		HTTPPort:    8081,
+		MaxInflight: 1,
+		AckWait:     time.Second * 30,
+	}
+
+	next := current
+	next.NatsAddress = "nats-2"
+	next.HTTPPort = 8082
+	next.MaxInflight = 10
+	next.AckWait = time.Minute
+
+	config, changed := keepRestartSettings(current, next)
+
+	if config.NatsAddress != "nats" || config.HTTPPort != 8081 {
+		t.Errorf("want NatsAddress and HTTPPort kept, got %s and %d", config.NatsAddress, config.HTTPPort)
+	}
+
+	if config.MaxInflight != 10 || config.AckWait != time.Minute {
+		t.Errorf("want MaxInflight and AckWait applied, got %d and %s", config.MaxInflight, config.AckWait)
+	}
+
+	if len(changed) != 2 || changed[0] != "faas_nats_address" || changed[1] != "http_port" {
+		t.Errorf("want faas_nats_address and http_port reported, got %v", changed)
+	}
+}
+
+func Test_worker_Reload(t *testing.T) {
+	w := newWorker(QueueWorkerConfig{AllowedNamespaces: []string{"openfaas-fn"}}, nil, nil)
+
+	if w.namespaces.Allowed("staging-fn") {
+		t.Fatalf("want staging-fn rejected before reload")
+	}
+
+	w.Reload(QueueWorkerConfig{AllowedNamespaces: []string{"openfaas-fn", "staging-fn"}}, nil)
+
+	if !w.namespaces.Allowed("staging-fn") {
+		t.Errorf("want staging-fn allowed after reload")
+	}
+}
+
+func Test_worker_Reload_KeepsSlotsInUse(t *testing.T) {
+	config := QueueWorkerConfig{
+		Namespaces: map[string]NamespaceConfig{"openfaas-fn": {MaxInflight: 1}},
+		Functions:  map[string]FunctionConfig{"figlet": {MaxInflight: 1}},
+	}
+	w := newWorker(config, nil, nil)
+
+	releaseNamespace, ok := w.namespaces.Acquire("openfaas-fn", 0)
+	if !ok {
+		t.Fatal("want the namespace's slot before reload")
+	}
+
+	releaseFunction, ok := w.functions.Acquire("figlet", 0)
+	if !ok {
+		t.Fatal("want the function's slot before reload")
+	}
+
+	w.Reload(config, nil)
+
+	if _, ok := w.namespaces.Acquire("openfaas-fn", 0); ok {
+		t.Error("want the namespace full after reload whilst its slot is held")
+	}
+
+	if _, ok := w.functions.Acquire("figlet", 0); ok {
+		t.Error("want the function full after reload whilst its slot is held")
+	}
+
+	config.Namespaces = map[string]NamespaceConfig{"openfaas-fn": {MaxInflight: 2}}
+	w.Reload(config, nil)
+
+	release, ok := w.namespaces.Acquire("openfaas-fn", 0)
+	if !ok {
+		t.Fatal("want a second slot once max_inflight is raised to 2")
+	}
+	defer release()
+
+	if _, ok := w.namespaces.Acquire("openfaas-fn", 0); ok {
+		t.Error("want the namespace full with both slots held")
+	}
+
+	releaseNamespace()
+	releaseFunction()
+
+	if _, ok := w.namespaces.Acquire("openfaas-fn", 0); !ok {
+		t.Error("want the namespace to have capacity once the slot held across the reload is released")
+	}
+
+	if _, ok := w.functions.Acquire("figlet", 0); !ok {
+		t.Error("want the function to have capacity once the slot held across the reload is released")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	truncatedHeader    = "X-Response-Truncated"
+	maxResponseHeader  = "X-Response-Max-Bytes"
+	responseSizeHeader = "X-Response-Bytes"
+)
+
+// limitedReader reads at most max bytes from a function's response and
+// records whether anything had to be dropped. A max of zero or less reads
+// the whole response.
+type limitedReader struct {
+	r   io.Reader
+	max int64
+
+	n         int64
+	truncated bool
+	finished  bool
+
+	// trailer is filled in once the response has been read, so that the
+	// outcome can be reported when the response is streamed to a callback.
+	trailer http.Header
+}
+
+func newLimitedReader(r io.Reader, max int64) *limitedReader {
+	return &limitedReader{r: r, max: max}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.finished {
+		return 0, io.EOF
+	}
+
+	if l.max > 0 {
+		if l.n >= l.max {
+			// Probe for one more byte to tell an exact fit from an overflow.
+			var b [1]byte
+			if n, _ := io.ReadFull(l.r, b[:]); n > 0 {
+				l.truncated = true
+			}
+			l.finish()
+			return 0, io.EOF
+		}
+
+		if remaining := l.max - l.n; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if err == io.EOF {
+		l.finish()
+	}
+
+	return n, err
+}
+
+func (l *limitedReader) finish() {
+	l.finished = true
+
+	if l.trailer != nil {
+		l.setHeaders(l.trailer)
+	}
+}
+
+// setHeaders reports the size of the response and whether it was truncated.
+func (l *limitedReader) setHeaders(header http.Header) {
+	header.Set(responseSizeHeader, strconv.FormatInt(l.n, 10))
+
+	if l.max > 0 {
+		header.Set(maxResponseHeader, strconv.FormatInt(l.max, 10))
+		header.Set(truncatedHeader, strconv.FormatBool(l.truncated))
+	}
+}
+
+// declareTrailers announces the size headers as trailers on a request which
+// streams this reader, their values are set once the reader is drained.
+func (l *limitedReader) declareTrailers(request *http.Request) {
+	request.Trailer = http.Header{}
+	request.Trailer[responseSizeHeader] = nil
+
+	if l.max > 0 {
+		request.Trailer[maxResponseHeader] = nil
+		request.Trailer[truncatedHeader] = nil
+	}
+
+	l.trailer = request.Trailer
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_limitedReader_NoLimit(t *testing.T) {
+	body := newLimitedReader(strings.NewReader("hello world"), 0)
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello world" {
+		t.Errorf("want %q, got %q", "hello world", string(got))
+	}
+
+	if body.truncated {
+		t.Errorf("want truncated false, got true")
+	}
+}
+
+func Test_limitedReader_ExactFit(t *testing.T) {
+	body := newLimitedReader(strings.NewReader("hello"), 5)
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello" {
+		t.Errorf("want %q, got %q", "hello", string(got))
+	}
+
+	if body.truncated {
+		t.Errorf("want truncated false, got true")
+	}
+}
+
+func Test_limitedReader_Truncates(t *testing.T) {
+	body := newLimitedReader(strings.NewReader("hello world"), 5)
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello" {
+		t.Errorf("want %q, got %q", "hello", string(got))
+	}
+
+	if !body.truncated {
+		t.Errorf("want truncated true, got false")
+	}
+
+	header := http.Header{}
+	body.setHeaders(header)
+
+	if v := header.Get(truncatedHeader); v != "true" {
+		t.Errorf("want %s: true, got %q", truncatedHeader, v)
+	}
+
+	if v := header.Get(maxResponseHeader); v != "5" {
+		t.Errorf("want %s: 5, got %q", maxResponseHeader, v)
+	}
+}
+
+func Test_postResult_StreamedResponseSendsTrailers(t *testing.T) {
+	var gotBody string
+	var gotTrailer http.Header
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		gotBody = string(data)
+		gotTrailer = r.Trailer
+	}))
+	defer srv.Close()
+
+	client := makeClient()
+	body := newLimitedReader(strings.NewReader("hello world"), 5)
+
+	statusCode, err := postResult(&client, nil, body, body, srv.URL, "call-1", http.StatusOK, "figlet", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if statusCode != http.StatusOK {
+		t.Errorf("want status %d, got %d", http.StatusOK, statusCode)
+	}
+
+	if gotBody != "hello" {
+		t.Errorf("want body %q, got %q", "hello", gotBody)
+	}
+
+	if v := gotTrailer.Get(truncatedHeader); v != "true" {
+		t.Errorf("want trailer %s: true, got %q", truncatedHeader, v)
+	}
+
+	if v := gotTrailer.Get(responseSizeHeader); v != "5" {
+		t.Errorf("want trailer %s: 5, got %q", responseSizeHeader, v)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	resultPending  = "pending"
+	resultComplete = "complete"
+
+	// resultTooLarge is stored without the headers and body of a result
+	// which is over the store's limit.
+	resultTooLarge = "too_large"
+)
+
+// StoredResult is the result of an invocation kept for clients which poll
+// rather than receive a callback.
+type StoredResult struct {
+	CallID       string      `json:"callId"`
+	Status       string      `json:"status"`
+	FunctionName string      `json:"name"`
+	StatusCode   int         `json:"statusCode,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         []byte      `json:"body,omitempty"`
+
+	ReceivedAt  time.Time `json:"receivedAt"`
+	CompletedAt time.Time `json:"completedAt,omitempty"`
+	TimeTaken   float64   `json:"timeTaken,omitempty"`
+}
+
+// ResultStore keeps results by their X-Call-Id until they expire.
+type ResultStore interface {
+	Put(result StoredResult) error
+	Get(callID string) (StoredResult, bool, error)
+}
+
+// newResultStore creates the store named in the config, or returns nil when
+// results are not to be stored.
+func newResultStore(config QueueWorkerConfig) (ResultStore, error) {
+	switch config.ResultStore {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryResultStore(config.ResultTTL, config.ResultMaxBytes), nil
+	}
+
+	return nil, fmt.Errorf("unknown result_store: %q", config.ResultStore)
+}
+
+type memoryEntry struct {
+	result  StoredResult
+	expires time.Time
+	size    int64
+}
+
+// memoryResultStore keeps results in memory, it is not shared between
+// replicas of the worker. At most maxBytes of results are kept, the oldest
+// are evicted first.
+type memoryResultStore struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	lock sync.RWMutex
+	size int64
+
+	// results holds a *memoryEntry for each call ID, in order of the
+	// last Put, oldest first.
+	results map[string]*list.Element
+	order   *list.List
+}
+
+func newMemoryResultStore(ttl time.Duration, maxBytes int64) *memoryResultStore {
+	s := &memoryResultStore{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		results:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+
+	go func() {
+		for range time.Tick(ttl) {
+			s.expire(time.Now())
+		}
+	}()
+
+	return s
+}
+
+func (s *memoryResultStore) Put(result StoredResult) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+
+	size := resultSize(result)
+	if s.maxBytes > 0 && size > s.maxBytes {
+		err = fmt.Errorf("result of %d bytes is over the limit of %d bytes", size, s.maxBytes)
+
+		result.Status = resultTooLarge
+		result.Header = nil
+		result.Body = nil
+		size = resultSize(result)
+	}
+
+	if element, ok := s.results[result.CallID]; ok {
+		s.remove(element)
+	}
+
+	for s.maxBytes > 0 && s.size+size > s.maxBytes {
+		oldest := s.order.Front()
+		log.Printf("Result store is full, evicting result for: %s", oldest.Value.(*memoryEntry).result.CallID)
+		s.remove(oldest)
+	}
+
+	s.results[result.CallID] = s.order.PushBack(&memoryEntry{
+		result:  result,
+		expires: time.Now().Add(s.ttl),
+		size:    size,
+	})
+	s.size += size
+
+	return err
+}
+
+func (s *memoryResultStore) Get(callID string) (StoredResult, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	element, ok := s.results[callID]
+	if !ok {
+		return StoredResult{}, false, nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if time.Now().After(entry.expires) {
+		return StoredResult{}, false, nil
+	}
+
+	return entry.result, true, nil
+}
+
+func (s *memoryResultStore) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, element := range s.results {
+		if now.After(element.Value.(*memoryEntry).expires) {
+			s.remove(element)
+		}
+	}
+}
+
+// remove deletes an entry, the lock must be held.
+func (s *memoryResultStore) remove(element *list.Element) {
+	entry := s.order.Remove(element).(*memoryEntry)
+
+	delete(s.results, entry.result.CallID)
+	s.size -= entry.size
+}
+
+// resultSize estimates the memory held by a result.
+func resultSize(result StoredResult) int64 {
+	size := len(result.CallID) + len(result.Status) + len(result.FunctionName) + len(result.Body)
+
+	for name, values := range result.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+
+	return int64(size)
+}
+
+// makeResultsHandler serves GET /results/{callId}, a pending result is
+// returned with a 202 status.
+func makeResultsHandler(store ResultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callID := r.PathValue("callId")
+
+		result, ok, err := store.Get(callID)
+		if err != nil {
+			log.Printf("Error getting result for %s: %s", callID, err)
+			http.Error(w, "unable to get result", http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
+			http.Error(w, fmt.Sprintf("no result found for: %s", callID), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if result.Status == resultPending {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_memoryResultStore_PutGet(t *testing.T) {
+	store := newMemoryResultStore(time.Minute, 0)
+
+	store.Put(StoredResult{CallID: "call-1", Status: resultComplete, StatusCode: http.StatusOK})
+
+	result, ok, err := store.Get("call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok || result.StatusCode != http.StatusOK {
+		t.Errorf("want stored result with status 200, got ok: %v, %d", ok, result.StatusCode)
+	}
+
+	if _, ok, _ := store.Get("call-2"); ok {
+		t.Errorf("want no result for call-2")
+	}
+}
+
+func Test_memoryResultStore_Expires(t *testing.T) {
+	store := newMemoryResultStore(time.Minute, 0)
+
+	store.Put(StoredResult{CallID: "call-1", Status: resultComplete})
+	store.expire(time.Now().Add(time.Minute * 2))
+
+	if _, ok, _ := store.Get("call-1"); ok {
+		t.Errorf("want result to have expired")
+	}
+}
+
+func Test_memoryResultStore_EvictsOldest(t *testing.T) {
+	body := make([]byte, 100)
+	size := resultSize(StoredResult{CallID: "call-1", Status: resultComplete, Body: body})
+	store := newMemoryResultStore(time.Minute, size*3)
+
+	for _, callID := range []string{"call-1", "call-2", "call-3"} {
+		if err := store.Put(StoredResult{CallID: callID, Status: resultComplete, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Putting call-1 again makes call-2 the oldest.
+	if err := store.Put(StoredResult{CallID: "call-1", Status: resultComplete, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(StoredResult{CallID: "call-4", Status: resultComplete, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := store.Get("call-2"); ok {
+		t.Errorf("want the oldest result evicted")
+	}
+
+	for _, callID := range []string{"call-1", "call-3", "call-4"} {
+		if _, ok, _ := store.Get(callID); !ok {
+			t.Errorf("want %s kept", callID)
+		}
+	}
+
+	if store.size > size*3 {
+		t.Errorf("want at most %d bytes, got %d", size*3, store.size)
+	}
+}
+
+func Test_memoryResultStore_MarksResultOverLimit(t *testing.T) {
+	store := newMemoryResultStore(time.Minute, 100)
+
+	store.Put(StoredResult{CallID: "call-1", Status: resultPending})
+
+	if err := store.Put(StoredResult{CallID: "call-1", Status: resultComplete, Body: make([]byte, 200)}); err == nil {
+		t.Fatal("want an error for a result over the limit")
+	}
+
+	result, ok, _ := store.Get("call-1")
+	if !ok || result.Status != resultTooLarge || len(result.Body) > 0 {
+		t.Errorf("want the pending result replaced by a too large marker, got %+v", result)
+	}
+
+	if store.size != resultSize(result) {
+		t.Errorf("want only the marker held, got %d bytes", store.size)
+	}
+}
+
+func Test_makeResultsHandler(t *testing.T) {
+	store := newMemoryResultStore(time.Minute, 0)
+	store.Put(StoredResult{CallID: "pending-1", Status: resultPending})
+	store.Put(StoredResult{CallID: "done-1", Status: resultComplete, StatusCode: http.StatusOK, Body: []byte("hello")})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /results/{callId}", makeResultsHandler(store))
+
+	cases := map[string]int{
+		"pending-1": http.StatusAccepted,
+		"done-1":    http.StatusOK,
+		"unknown":   http.StatusNotFound,
+	}
+
+	for callID, want := range cases {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/results/"+callID, nil))
+
+		if rr.Code != want {
+			t.Errorf("%s want status %d, got %d", callID, want, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/results/done-1", nil))
+
+	result := StoredResult{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(result.Body) != "hello" {
+		t.Errorf("want body hello, got %q", string(result.Body))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+)
+
+const (
+	// callbackSubjectAnnotation publishes the result to a NATS subject.
+	callbackSubjectAnnotation = "callback-subject"
+
+	// callbackChannelAnnotation publishes the result to a NATS Streaming
+	// channel.
+	callbackChannelAnnotation = "callback-channel"
+)
+
+// resultPublisher publishes results for callbacks which are given as a NATS
+// subject or NATS Streaming channel rather than a HTTP URL.
+type resultPublisher interface {
+	publish(subject string, streaming bool, data []byte) error
+}
+
+// resultSubject returns the NATS subject or NATS Streaming channel the
+// result should be published to, either from the callback-subject and
+// callback-channel annotations, or a nats:// or stan:// callback URL.
+func resultSubject(req *ftypes.QueueRequest) (subject string, streaming bool) {
+	if v := req.Annotations[callbackSubjectAnnotation]; len(v) > 0 {
+		return v, false
+	}
+
+	if v := req.Annotations[callbackChannelAnnotation]; len(v) > 0 {
+		return v, true
+	}
+
+	if req.CallbackURL == nil {
+		return "", false
+	}
+
+	scheme := strings.ToLower(req.CallbackURL.Scheme)
+	if scheme != "nats" && scheme != "stan" {
+		return "", false
+	}
+
+	subject = req.CallbackURL.Host
+	if path := strings.Trim(req.CallbackURL.Path, "/"); len(path) > 0 {
+		subject += "." + strings.ReplaceAll(path, "/", ".")
+	}
+
+	return subject, scheme == "stan"
+}
+
+// marshalResult encodes the result of an invocation for publishing to NATS.
+func marshalResult(functionRes *http.Response, result []byte, body *limitedReader, xCallID string,
+	statusCode int, functionName string, timeTaken float64) ([]byte, error) {
+
+	header := http.Header{}
+	if functionRes != nil {
+		copyHeaders(header, &functionRes.Header)
+	}
+
+	if body != nil {
+		body.setHeaders(header)
+	}
+
+	return json.Marshal(AsyncResult{
+		AsyncReport: AsyncReport{
+			FunctionName: functionName,
+			StatusCode:   statusCode,
+			TimeTaken:    timeTaken,
+		},
+		CallID: xCallID,
+		Header: header,
+		Body:   result,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+func Test_resultSubject_Annotation(t *testing.T) {
+	req := ftypes.QueueRequest{
+		Annotations: map[string]string{callbackSubjectAnnotation: "results.orders"},
+	}
+
+	subject, streaming := resultSubject(&req)
+	if subject != "results.orders" || streaming {
+		t.Errorf("want results.orders over NATS, got %q streaming: %v", subject, streaming)
+	}
+}
+
+func Test_resultSubject_ChannelAnnotation(t *testing.T) {
+	req := ftypes.QueueRequest{
+		Annotations: map[string]string{callbackChannelAnnotation: "results"},
+	}
+
+	subject, streaming := resultSubject(&req)
+	if subject != "results" || !streaming {
+		t.Errorf("want results over NATS Streaming, got %q streaming: %v", subject, streaming)
+	}
+}
+
+func Test_resultSubject_NATSCallbackURL(t *testing.T) {
+	u, _ := url.Parse("nats://results/orders")
+	req := ftypes.QueueRequest{CallbackURL: u}
+
+	subject, streaming := resultSubject(&req)
+	if subject != "results.orders" || streaming {
+		t.Errorf("want results.orders over NATS, got %q streaming: %v", subject, streaming)
+	}
+}
+
+func Test_resultSubject_HTTPCallbackURL(t *testing.T) {
+	u, _ := url.Parse("http://example.com/cb")
+	req := ftypes.QueueRequest{CallbackURL: u}
+
+	if subject, _ := resultSubject(&req); subject != "" {
+		t.Errorf("want no subject for a HTTP callback, got %q", subject)
+	}
+}
+
+func Test_CallbackPolicy_CheckSubject(t *testing.T) {
+	policy := CallbackPolicy{}
+
+	for _, subject := range []string{"_STAN.discover", "_INBOX.x", sharedQueue, "results.*", ""} {
+		if err := policy.CheckSubject(subject); err == nil {
+			t.Errorf("want %q to be rejected", subject)
+		}
+	}
+
+	policy.AllowedSubjects = []string{"results.>"}
+	if err := policy.CheckSubject("results.orders"); err != nil {
+		t.Errorf("want results.orders to be allowed, got: %s", err)
+	}
+
+	if err := policy.CheckSubject("orders"); err == nil {
+		t.Errorf("want orders to be rejected")
+	}
+}
+
+func Test_CallbackPolicy_CheckSubject_Reserved(t *testing.T) {
+	t.Setenv("status_subject", "status.events")
+	t.Setenv("circuit_holding_channel", "faas-request-held")
+	t.Setenv("callback_allowed_subjects", ">")
+
+	config, err := ReadConfig{}.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := config.CallbackPolicy
+
+	cases := map[string]string{
+		"status subject":        "status.events",
+		"default status":        lifecycle.DefaultSubject,
+		"holding channel":       "faas-request-held",
+		"queue channel":         sharedQueue,
+		"NATS Streaming prefix": "_STAN.acks",
+	}
+
+	for name, subject := range cases {
+		if err := policy.CheckSubject(subject); err == nil {
+			t.Errorf("%s: want %q to be rejected", name, subject)
+		}
+	}
+
+	if err := policy.CheckSubject("results.orders"); err != nil {
+		t.Errorf("want results.orders to be allowed, got: %s", err)
+	}
+}
+
+type fakePublisher struct {
+	subject   string
+	streaming bool
+	data      []byte
+}
+
+func (f *fakePublisher) publish(subject string, streaming bool, data []byte) error {
+	f.subject = subject
+	f.streaming = streaming
+	f.data = data
+	return nil
+}
+
+func Test_worker_publishResult(t *testing.T) {
+	publisher := &fakePublisher{}
+	w := &worker{results: publisher}
+
+	res := &http.Response{Header: http.Header{"Content-Type": []string{"text/plain"}}}
+	w.publishResult(1, "results", true, res, []byte("hello"), nil, "call-1", http.StatusOK, "figlet", 0.5)
+
+	if publisher.subject != "results" || !publisher.streaming {
+		t.Fatalf("want result published to results over NATS Streaming, got %q streaming: %v", publisher.subject, publisher.streaming)
+	}
+
+	result := AsyncResult{}
+	if err := json.Unmarshal(publisher.data, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.FunctionName != "figlet" || result.StatusCode != http.StatusOK || result.CallID != "call-1" {
+		t.Errorf("want figlet, 200, call-1, got %s, %d, %s", result.FunctionName, result.StatusCode, result.CallID)
+	}
+
+	if string(result.Body) != "hello" {
+		t.Errorf("want body hello, got %q", string(result.Body))
+	}
+
+	if result.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("want Content-Type text/plain, got %q", result.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+)
+
+const (
+	startAll      = "all"
+	startNew      = "new"
+	startLast     = "last"
+	startSequence = "sequence"
+	startTime     = "time"
+)
+
+// StartPosition is where a new durable subscription starts reading the
+// channel, an existing durable always resumes from where it left off.
+type StartPosition struct {
+	Kind     string
+	Sequence uint64
+	Time     time.Time
+	Ago      time.Duration
+}
+
+// parseStartPosition parses one of: all, new, last, sequence:<n>,
+// time:<RFC3339> or time:<duration>, where a duration is how long ago.
+func parseStartPosition(value string) (StartPosition, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(value), ":")
+
+	switch kind {
+	case startAll, startNew, startLast:
+		if len(arg) > 0 {
+			return StartPosition{}, fmt.Errorf("%s takes no value, got: %q", kind, value)
+		}
+
+		return StartPosition{Kind: kind}, nil
+	case startSequence:
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || seq == 0 {
+			return StartPosition{}, fmt.Errorf("want sequence:<n> with n > 0, got: %q", value)
+		}
+
+		return StartPosition{Kind: kind, Sequence: seq}, nil
+	case startTime:
+		if t, err := time.Parse(time.RFC3339, arg); err == nil {
+			return StartPosition{Kind: kind, Time: t}, nil
+		}
+
+		ago, err := time.ParseDuration(arg)
+		if err != nil || ago <= 0 {
+			return StartPosition{}, fmt.Errorf("want time:<RFC3339> or time:<duration>, got: %q", value)
+		}
+
+		return StartPosition{Kind: kind, Ago: ago}, nil
+	}
+
+	return StartPosition{}, fmt.Errorf("want all, new, last, sequence:<n> or time:<t>, got: %q", value)
+}
+
+// option returns the subscription option for the position.
+func (p StartPosition) option() stan.SubscriptionOption {
+	switch p.Kind {
+	case startNew:
+		return stan.StartAt(pb.StartPosition_NewOnly)
+	case startLast:
+		return stan.StartWithLastReceived()
+	case startSequence:
+		return stan.StartAtSequence(p.Sequence)
+	case startTime:
+		if p.Ago > 0 {
+			return stan.StartAtTimeDelta(p.Ago)
+		}
+
+		return stan.StartAtTime(p.Time)
+	}
+
+	return stan.DeliverAllAvailable()
+}
+
+func (p StartPosition) String() string {
+	switch p.Kind {
+	case startSequence:
+		return fmt.Sprintf("%s:%d", p.Kind, p.Sequence)
+	case startTime:
+		if p.Ago > 0 {
+			return fmt.Sprintf("%s:%s", p.Kind, p.Ago)
+		}
+
+		return fmt.Sprintf("%s:%s", p.Kind, p.Time.Format(time.RFC3339))
+	case "":
+		return startAll
+	}
+
+	return p.Kind
+}
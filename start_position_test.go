@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseStartPosition(t *testing.T) {
+	cases := map[string]StartPosition{
+		"all":                       {Kind: startAll},
+		"new":                       {Kind: startNew},
+		"last":                      {Kind: startLast},
+		"sequence:42":               {Kind: startSequence, Sequence: 42},
+		"time:1h":                   {Kind: startTime, Ago: time.Hour},
+		"time:2024-05-01T10:00:00Z": {Kind: startTime, Time: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for value, want := range cases {
+		got, err := parseStartPosition(value)
+		if err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+
+		if got.Kind != want.Kind || got.Sequence != want.Sequence || got.Ago != want.Ago || !got.Time.Equal(want.Time) {
+			t.Errorf("%s want %+v, got %+v", value, want, got)
+		}
+
+		if again, _ := parseStartPosition(got.String()); again != got {
+			t.Errorf("%s want String() to parse to the same position, got %s", value, got)
+		}
+	}
+}
+
+func Test_parseStartPosition_Invalid(t *testing.T) {
+	for _, value := range []string{"", "first", "sequence:0", "sequence:abc", "time:yesterday", "new:1"} {
+		if _, err := parseStartPosition(value); err == nil {
+			t.Errorf("%q want error", value)
+		}
+	}
+}
+
+func Test_StartPosition_String_Default(t *testing.T) {
+	if got := (StartPosition{}).String(); got != "all" {
+		t.Errorf("want all for the zero value, got %s", got)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+// callStatus is the lifecycle of a single invocation.
+type callStatus struct {
+	callID  string
+	events  []lifecycle.Event
+	expires time.Time
+	size    int64
+}
+
+// statusTracker records the lifecycle of invocations by their X-Call-Id and
+// exports each transition as an event on a NATS subject. Events from the
+// publisher and other workers are received on the same subject, so that any
+// worker can report on any invocation. At most maxBytes of events are kept,
+// the invocations which changed least recently are evicted first.
+type statusTracker struct {
+	workerID  string
+	subject   string
+	ttl       time.Duration
+	maxBytes  int64
+	publisher resultPublisher
+
+	lock sync.RWMutex
+	size int64
+
+	// calls holds a *callStatus for each call ID, in order of the last
+	// event, oldest first.
+	calls map[string]*list.Element
+	order *list.List
+}
+
+func newStatusTracker(workerID, subject string, ttl time.Duration, maxBytes int64) *statusTracker {
+	t := &statusTracker{
+		workerID: workerID,
+		subject:  subject,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		calls:    map[string]*list.Element{},
+		order:    list.New(),
+	}
+
+	go func() {
+		for range time.Tick(ttl) {
+			t.expire(time.Now())
+		}
+	}()
+
+	return t
+}
+
+// Record adds a transition for callID and publishes it as an event.
+func (t *statusTracker) Record(callID, function string, state lifecycle.State, statusCode int, message string) {
+	event := lifecycle.Event{
+		CallID:     callID,
+		State:      state,
+		Function:   function,
+		Timestamp:  time.Now(),
+		WorkerID:   t.workerID,
+		StatusCode: statusCode,
+		Message:    message,
+	}
+
+	t.add(event)
+
+	if t.publisher == nil || len(t.subject) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Unable to marshal status event for: %s, error: %s", callID, err)
+		return
+	}
+
+	if err := t.publisher.publish(t.subject, false, data); err != nil {
+		log.Printf("Error publishing status event for: %s, error: %s", callID, err)
+	}
+}
+
+// Ingest records an event received from NATS, events published by this
+// worker have already been recorded.
+func (t *statusTracker) Ingest(data []byte) {
+	event := lifecycle.Event{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Unable to unmarshal status event: %s", err)
+		return
+	}
+
+	if event.WorkerID == t.workerID || len(event.CallID) == 0 {
+		return
+	}
+
+	t.add(event)
+}
+
+// Get returns the events recorded for callID in the order they happened.
+func (t *statusTracker) Get(callID string) ([]lifecycle.Event, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	element, ok := t.calls[callID]
+	if !ok {
+		return nil, false
+	}
+
+	status := element.Value.(*callStatus)
+	if time.Now().After(status.expires) {
+		return nil, false
+	}
+
+	events := make([]lifecycle.Event, len(status.events))
+	copy(events, status.events)
+
+	return events, true
+}
+
+func (t *statusTracker) add(event lifecycle.Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var status *callStatus
+	if element, ok := t.calls[event.CallID]; ok {
+		status = element.Value.(*callStatus)
+		t.order.MoveToBack(element)
+	} else {
+		status = &callStatus{callID: event.CallID}
+		t.calls[event.CallID] = t.order.PushBack(status)
+	}
+
+	size := eventSize(event)
+	status.events = append(status.events, event)
+	status.expires = time.Now().Add(t.ttl)
+	status.size += size
+	t.size += size
+
+	for t.maxBytes > 0 && t.size > t.maxBytes && t.order.Len() > 1 {
+		oldest := t.order.Front()
+		log.Printf("Status tracker is full, evicting status for: %s", oldest.Value.(*callStatus).callID)
+		t.remove(oldest)
+	}
+
+	// Events from other publishers and workers can arrive out of order.
+	sort.SliceStable(status.events, func(i, j int) bool {
+		return status.events[i].Timestamp.Before(status.events[j].Timestamp)
+	})
+}
+
+func (t *statusTracker) expire(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, element := range t.calls {
+		if now.After(element.Value.(*callStatus).expires) {
+			t.remove(element)
+		}
+	}
+}
+
+// remove deletes an invocation's status, the lock must be held.
+func (t *statusTracker) remove(element *list.Element) {
+	status := t.order.Remove(element).(*callStatus)
+
+	delete(t.calls, status.callID)
+	t.size -= status.size
+}
+
+// eventSize estimates the memory held by an event.
+func eventSize(event lifecycle.Event) int64 {
+	return int64(len(event.CallID) + len(event.State) + len(event.Function) + len(event.WorkerID) + len(event.Message))
+}
+
+// callStatusResponse is returned from GET /status/{callId}.
+type callStatusResponse struct {
+	CallID string            `json:"callId"`
+	State  lifecycle.State   `json:"state"`
+	Events []lifecycle.Event `json:"events"`
+}
+
+// makeStatusHandler serves GET /status/{callId} with the current state of
+// an invocation and each of its transitions.
+func makeStatusHandler(t *statusTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		callID := r.PathValue("callId")
+
+		events, ok := t.Get(callID)
+		if !ok || len(events) == 0 {
+			http.Error(w, fmt.Sprintf("no status found for: %s", callID), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(callStatusResponse{
+			CallID: callID,
+			State:  events[len(events)-1].State,
+			Events: events,
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	"github.com/nats-io/stan.go/pb"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+func Test_statusTracker_RecordPublishesEvent(t *testing.T) {
+	publisher := &fakePublisher{}
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, DefaultStatusMaxBytes)
+	tracker.publisher = publisher
+
+	tracker.Record("call-1", "figlet", lifecycle.Succeeded, http.StatusOK, "")
+
+	if publisher.subject != lifecycle.DefaultSubject {
+		t.Fatalf("want event published to %s, got %q", lifecycle.DefaultSubject, publisher.subject)
+	}
+
+	event := lifecycle.Event{}
+	if err := json.Unmarshal(publisher.data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.State != lifecycle.Succeeded || event.WorkerID != "worker-1" || event.StatusCode != http.StatusOK {
+		t.Errorf("want succeeded event from worker-1 with 200, got %+v", event)
+	}
+}
+
+func Test_statusTracker_IngestOrdersEvents(t *testing.T) {
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, DefaultStatusMaxBytes)
+
+	queued := time.Now().Add(-time.Second)
+	tracker.Record("call-1", "figlet", lifecycle.Received, 0, "")
+
+	data, _ := json.Marshal(lifecycle.Event{
+		CallID:    "call-1",
+		State:     lifecycle.Queued,
+		Function:  "figlet",
+		Timestamp: queued,
+		WorkerID:  "faas-publisher-gateway",
+	})
+	tracker.Ingest(data)
+
+	events, ok := tracker.Get("call-1")
+	if !ok || len(events) != 2 {
+		t.Fatalf("want 2 events, got %d", len(events))
+	}
+
+	if events[0].State != lifecycle.Queued || events[1].State != lifecycle.Received {
+		t.Errorf("want queued then received, got %s then %s", events[0].State, events[1].State)
+	}
+}
+
+func Test_statusTracker_IngestSkipsOwnEvents(t *testing.T) {
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, DefaultStatusMaxBytes)
+
+	data, _ := json.Marshal(lifecycle.Event{
+		CallID:   "call-1",
+		State:    lifecycle.Received,
+		WorkerID: "worker-1",
+	})
+	tracker.Ingest(data)
+
+	if _, ok := tracker.Get("call-1"); ok {
+		t.Errorf("want events from this worker to be skipped")
+	}
+}
+
+func Test_statusTracker_EvictsLeastRecentlyChanged(t *testing.T) {
+	size := eventSize(lifecycle.Event{CallID: "call-1", State: lifecycle.Received, Function: "figlet", WorkerID: "worker-1"})
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, size*3)
+
+	for _, callID := range []string{"call-1", "call-2", "call-3"} {
+		tracker.Record(callID, "figlet", lifecycle.Received, 0, "")
+	}
+
+	// call-1 changed most recently, so call-2 makes way for its event.
+	tracker.Record("call-1", "figlet", lifecycle.Received, 0, "")
+
+	if _, ok := tracker.Get("call-2"); ok {
+		t.Errorf("want call-2 evicted")
+	}
+
+	if events, ok := tracker.Get("call-1"); !ok || len(events) != 2 {
+		t.Errorf("want 2 events kept for call-1, got %d", len(events))
+	}
+
+	if _, ok := tracker.Get("call-3"); !ok {
+		t.Errorf("want call-3 kept")
+	}
+
+	if tracker.size != size*3 {
+		t.Errorf("want size %d, got %d", size*3, tracker.size)
+	}
+}
+
+func Test_makeStatusHandler(t *testing.T) {
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, DefaultStatusMaxBytes)
+	tracker.Record("call-1", "figlet", lifecycle.Received, 0, "")
+	tracker.Record("call-1", "figlet", lifecycle.Invoking, 0, "")
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /status/{callId}", makeStatusHandler(tracker))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/status/call-1", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("want status 200, got %d", rr.Code)
+	}
+
+	res := callStatusResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.State != lifecycle.Invoking || len(res.Events) != 2 {
+		t.Errorf("want state invoking with 2 events, got %s with %d", res.State, len(res.Events))
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/status/unknown", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("want status 404, got %d", rr.Code)
+	}
+}
+
+func Test_deferMessage_RecordsDeadLettered(t *testing.T) {
+	statusPublisher := &fakePublisher{}
+	tracker := newStatusTracker("worker-1", lifecycle.DefaultSubject, time.Minute, DefaultStatusMaxBytes)
+	tracker.publisher = statusPublisher
+
+	holding := &fakePublisher{}
+	w := &worker{results: holding, status: tracker}
+
+	req := &ftypes.QueueRequest{Function: "figlet", Header: http.Header{"X-Call-Id": []string{"call-1"}}}
+	msg := &stan.Msg{MsgProto: pb.MsgProto{Data: []byte("{}")}}
+
+	if !w.deferMessage(1, msg, req, "openfaas-fn", "faas-request-held") {
+		t.Fatal("want the message acked once moved to the holding channel")
+	}
+
+	if holding.subject != "faas-request-held" {
+		t.Fatalf("want the message moved to faas-request-held, got %q", holding.subject)
+	}
+
+	events, ok := tracker.Get("call-1")
+	if !ok || len(events) != 1 || events[0].State != lifecycle.DeadLettered {
+		t.Fatalf("want a dead-lettered event, got %+v", events)
+	}
+
+	if !events[0].State.Final() {
+		t.Errorf("want dead-lettered to be final")
+	}
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
+	natsqw "github.com/openfaas/nats-queue-worker/nats"
 )
 
 // AsyncReport is the report from a function executed on a queue worker.
@@ -17,82 +20,198 @@ type AsyncReport struct {
 	TimeTaken    float64 `json:"timeTaken"`
 }
 
+// AsyncResult is published to a NATS subject or NATS Streaming channel with
+// the result of a function executed on a queue worker.
+type AsyncResult struct {
+	AsyncReport
+
+	CallID string      `json:"callId,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
 // NATSQueue represents a subscription to NATS Streaming
 type NATSQueue struct {
 	clusterID string
 	clientID  string
 	natsURL   string
 
+	// connectOptions tune the connection, natsURL already holds their
+	// servers.
+	connectOptions natsqw.ConnectOptions
+
 	maxReconnect   int
 	reconnectDelay time.Duration
-	conn           stan.Conn
-	connMutex      *sync.RWMutex
-	quitCh         chan struct{}
+
+	// manager connects and reconnects, conn is set each time it connects.
+	manager   *natsqw.Manager
+	events    *natsqw.Events
+	conn      stan.Conn
+	connMutex *sync.RWMutex
 
 	subject        string
 	qgroup         string
 	ackWait        time.Duration
-	messageHandler func(*stan.Msg)
+	messageHandler func(*stan.Msg) bool
 	maxInFlight    int
 	subscription   stan.Subscription
 	msgChan        chan *stan.Msg
+	stopWorker     chan struct{}
+	workers        int
+
+	// closed stops the workers, and the subscription's handler from
+	// waiting for one, once the connection is closed.
+	closed chan struct{}
+
+	// workerLimit runs fewer workers than maxInFlight when set.
+	workerLimit int
+
+	// subscribedInFlight is the MaxInflight of the subscription, which
+	// follows the worker count so that messages don't wait behind the
+	// workers past ackWait.
+	subscribedInFlight int
+
+	// durableName defaults to the subject when empty.
+	durableName        string
+	startPosition      StartPosition
+	unsubscribeOnClose bool
+
+	pauseMutex sync.RWMutex
+	paused     bool
+	inflight   sync.WaitGroup
+
+	// resubscribeMutex stops the subscription being made again twice at
+	// once.
+	resubscribeMutex sync.Mutex
+
+	// statusHandler receives lifecycle events published to statusSubject
+	// when set.
+	statusSubject string
+	statusHandler func([]byte)
 }
 
-// connect creates a subscription to NATS Streaming
+// connect creates a subscription to NATS Streaming, which is created again
+// each time the connection is lost and made again.
 func (q *NATSQueue) connect() error {
-	log.Printf("Connect: %s\n", q.natsURL)
-
-	nc, err := stan.Connect(
-		q.clusterID,
-		q.clientID,
-		stan.NatsURL(q.natsURL),
-		stan.SetConnectionLostHandler(func(conn stan.Conn, err error) {
-			log.Printf("Disconnected from %s\n", q.natsURL)
+	q.manager = natsqw.NewManager(natsqw.ManagerConfig{
+		ClusterID:    q.clusterID,
+		ClientID:     q.clientID,
+		NatsURL:      q.natsURL,
+		Options:      q.connectOptions,
+		MaxReconnect: q.maxReconnect,
+		Backoff: natsqw.Backoff{
+			Initial: q.reconnectDelay,
+			Max:     natsqw.DefaultMaxBackoff,
+			Jitter:  natsqw.DefaultJitter,
+		},
+		OnConnect:     q.onConnect,
+		Subscriptions: q.subscriptions,
+		Events:        q.events,
+	})
 
-			q.reconnect()
-		}),
-	)
-	if err != nil {
+	if err := q.manager.Connect(); err != nil {
 		return fmt.Errorf("can't connect to %s: %v", q.natsURL, err)
 	}
 
+	return nil
+}
+
+// onConnect subscribes with a new connection.
+func (q *NATSQueue) onConnect(nc stan.Conn) error {
 	q.connMutex.Lock()
 	defer q.connMutex.Unlock()
 
 	q.conn = nc
 
+	// A subscription is lost with the connection it was made on.
+	q.subscription = nil
+
+	if q.statusHandler != nil {
+		if _, err := nc.NatsConn().Subscribe(q.statusSubject, func(msg *nats.Msg) {
+			q.statusHandler(msg.Data)
+		}); err != nil {
+			return fmt.Errorf("couldn't subscribe to %s at %s. Error: %v", q.statusSubject, q.natsURL, err)
+		}
+
+		log.Printf("Listening for status events on [%s]\n", q.statusSubject)
+	}
+
+	if q.isPaused() {
+		log.Printf("Paused, not subscribing to: %s\n", q.subject)
+		return nil
+	}
+
+	return q.subscribe()
+}
+
+// subscriptions returns the subject of the subscription, when subscribed.
+func (q *NATSQueue) subscriptions() []string {
+	q.connMutex.RLock()
+	defer q.connMutex.RUnlock()
+
+	if q.subscription == nil {
+		return nil
+	}
+
+	return []string{q.subject}
+}
+
+// OnEvent calls handler with each of the connection's events, until
+// unsubscribe is called.
+func (q *NATSQueue) OnEvent(handler natsqw.EventHandler) (unsubscribe func()) {
+	return q.events.Subscribe(handler)
+}
+
+// State returns the state of the connection, it is safe to call
+// concurrently.
+func (q *NATSQueue) State() natsqw.State {
+	return q.events.State()
+}
+
+// subscribe creates the durable queue subscription, connMutex must be held.
+func (q *NATSQueue) subscribe() error {
 	log.Printf("Subscribing to: %s at %s\n", q.subject, q.natsURL)
 	log.Println("Wait for ", q.ackWait)
 
-	// Pre-fill chan with q.maxInFlight tokens
-	msgChan := make(chan *stan.Msg)
-
 	if q.maxInFlight <= 0 {
 		q.maxInFlight = 1
 	}
 
-	handler := q.messageHandler
-	opts := []stan.SubscriptionOption{
-		stan.DurableName(strings.ReplaceAll(q.subject, ".", "_")),
-		stan.AckWait(q.ackWait),
-		stan.DeliverAllAvailable(),
-		stan.MaxInflight(q.maxInFlight),
-	}
-	if q.maxInFlight > 1 {
-		for i := 0; i < q.maxInFlight; i++ {
-			go func() {
-				for msg := range msgChan {
-					q.messageHandler(msg)
-					msg.Ack()
-				}
-			}()
+	q.resizeWorkers(q.workerCount())
+
+	handler := func(msg *stan.Msg) {
+		q.pauseMutex.RLock()
+		if q.paused {
+			q.pauseMutex.RUnlock()
+			return
 		}
+		q.inflight.Add(1)
+		q.pauseMutex.RUnlock()
 
-		opts = append(opts, stan.SetManualAckMode())
-		handler = func(msg *stan.Msg) {
-			msgChan <- msg
+		// There may be fewer workers than MaxInflight, so one may not
+		// become free before the connection is closed.
+		select {
+		case q.msgChan <- msg:
+		case <-q.closed:
+			q.inflight.Done()
 		}
 	}
+
+	durableName := q.durableName
+	if len(durableName) == 0 {
+		durableName = strings.ReplaceAll(q.subject, ".", "_")
+	}
+
+	q.subscribedInFlight = q.workerCount()
+
+	opts := []stan.SubscriptionOption{
+		stan.DurableName(durableName),
+		stan.AckWait(q.ackWait),
+		q.startPosition.option(),
+		stan.MaxInflight(q.subscribedInFlight),
+		stan.SetManualAckMode(),
+	}
+
 	subscription, err := q.conn.QueueSubscribe(
 		q.subject,
 		q.qgroup,
@@ -105,43 +224,240 @@ func (q *NATSQueue) connect() error {
 	}
 
 	log.Printf(
-		"Listening on [%s], clientID=[%s], qgroup=[%s] maxInFlight=[%d]\n",
+		"Listening on [%s], clientID=[%s], qgroup=[%s] durable=[%s] start=[%s] maxInFlight=[%d]\n",
 		q.subject,
 		q.clientID,
 		q.qgroup,
-		q.maxInFlight,
+		durableName,
+		q.startPosition,
+		q.subscribedInFlight,
 	)
 
 	q.subscription = subscription
-	q.msgChan = msgChan
 
 	return nil
 }
 
-func (q *NATSQueue) reconnect() {
-	log.Printf("Reconnect\n")
+// resizeWorkers starts or stops workers so that n messages can be handled
+// concurrently. A worker which is stopped finishes its current message first.
+func (q *NATSQueue) resizeWorkers(n int) {
+	// The channel is kept for the lifetime of the queue and never closed,
+	// as a message may be being handed to a worker, closed is used instead.
+	if q.msgChan == nil {
+		q.msgChan = make(chan *stan.Msg)
+		q.stopWorker = make(chan struct{})
+		q.closed = make(chan struct{})
+	}
 
-	for i := 0; i < q.maxReconnect; i++ {
-		select {
-		case <-time.After(time.Duration(i) * q.reconnectDelay):
-			if err := q.connect(); err == nil {
-				log.Printf("Reconnecting (%d/%d) to %s succeeded\n", i+1, q.maxReconnect, q.natsURL)
+	for ; q.workers < n; q.workers++ {
+		go q.work()
+	}
 
-				return
-			}
+	// Workers are stopped asynchronously as one which is busy could be
+	// waiting on connMutex to publish a result.
+	for ; q.workers > n; q.workers-- {
+		go func() {
+			q.stopWorker <- struct{}{}
+		}()
+	}
+}
+
+// setWorkerLimit runs at most n workers, maxInFlight remains the ceiling.
+// The subscription is made again with a new MaxInflight once the worker count
+// has halved or doubled, otherwise NATS Streaming would keep delivering
+// messages which wait for a worker past ackWait and are redelivered.
+func (q *NATSQueue) setWorkerLimit(n int) {
+	q.connMutex.Lock()
+
+	q.workerLimit = n
+
+	// Workers are started when subscribing.
+	if q.msgChan == nil {
+		q.connMutex.Unlock()
+		return
+	}
+
+	count := q.workerCount()
+	q.resizeWorkers(count)
 
-			nextTryIn := (time.Duration(i+1) * q.reconnectDelay).String()
+	resubscribe := q.subscription != nil && outgrown(count, q.subscribedInFlight)
+	q.connMutex.Unlock()
+
+	if resubscribe {
+		go q.resubscribe()
+	}
+}
+
+// outgrown returns true when the subscription's MaxInflight is at least
+// twice, or at most half, the number of workers.
+func outgrown(workers, inFlight int) bool {
+	return workers*2 <= inFlight || workers >= inFlight*2
+}
+
+// resubscribe pauses and resumes, so that the subscription is made again
+// with the current worker count once invocations in progress are acked.
+func (q *NATSQueue) resubscribe() {
+	q.resubscribeMutex.Lock()
+	defer q.resubscribeMutex.Unlock()
+
+	q.connMutex.RLock()
+	current := q.subscription == nil || !outgrown(q.workerCount(), q.subscribedInFlight)
+	q.connMutex.RUnlock()
+
+	// Already paused or made again, the worker count is used once resumed.
+	if current || q.isPaused() {
+		return
+	}
 
-			log.Printf("Reconnecting (%d/%d) to %s failed\n", i+1, q.maxReconnect, q.natsURL)
-			log.Printf("Waiting %s before next try", nextTryIn)
-		case <-q.quitCh:
-			log.Println("Received signal to stop reconnecting...")
+	log.Printf("Subscribing to %s again for %d workers\n", q.subject, q.workerCount())
 
+	if err := q.pause(); err != nil {
+		log.Printf("Error pausing to subscribe again: %s\n", err)
+	}
+
+	if err := q.resume(); err != nil {
+		log.Printf("Error subscribing again: %s\n", err)
+	}
+}
+
+func (q *NATSQueue) workerCount() int {
+	if q.workerLimit > 0 && q.workerLimit < q.maxInFlight {
+		return q.workerLimit
+	}
+
+	return q.maxInFlight
+}
+
+// work handles messages until the connection is closed or it is stopped.
+// Messages are only acked once they have been handled, so that any received
+// whilst pausing, or deferred by the handler returning false, are
+// redelivered.
+func (q *NATSQueue) work() {
+	for {
+		select {
+		case msg := <-q.msgChan:
+			if q.messageHandler(msg) {
+				msg.Ack()
+			}
+			q.inflight.Done()
+		case <-q.stopWorker:
+			return
+		case <-q.closed:
 			return
 		}
 	}
+}
+
+// reconfigure applies a new maxInFlight and ackWait, which are options of
+// the subscription. The subscription is paused, so that invocations in
+// progress complete and are acked, then recreated with the new options.
+func (q *NATSQueue) reconfigure(maxInFlight int, ackWait time.Duration) error {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+
+	q.connMutex.RLock()
+	unchanged := q.maxInFlight == maxInFlight && q.ackWait == ackWait
+	q.connMutex.RUnlock()
+
+	if unchanged {
+		return nil
+	}
 
-	log.Printf("Reconnecting limit (%d) reached\n", q.maxReconnect)
+	wasPaused := q.isPaused()
+	if err := q.pause(); err != nil {
+		return err
+	}
+
+	q.connMutex.Lock()
+	log.Printf("Reconfiguring maxInFlight: %d => %d, ackWait: %s => %s\n", q.maxInFlight, maxInFlight, q.ackWait, ackWait)
+	q.maxInFlight = maxInFlight
+	q.ackWait = ackWait
+	q.connMutex.Unlock()
+
+	if wasPaused {
+		return nil
+	}
+
+	return q.resume()
+}
+
+// pause stops consuming from the queue without removing the durable
+// subscription. Invocations in progress are given up to ackWait to complete
+// before the subscription is closed, any messages received after pausing are
+// not acked and will be redelivered once resumed.
+func (q *NATSQueue) pause() error {
+	q.pauseMutex.Lock()
+	if q.paused {
+		q.pauseMutex.Unlock()
+		return nil
+	}
+	q.paused = true
+	q.pauseMutex.Unlock()
+
+	// reconfigure may change ackWait whilst waiting.
+	q.connMutex.RLock()
+	ackWait := q.ackWait
+	q.connMutex.RUnlock()
+
+	log.Printf("Pausing, waiting for invocations in progress to complete\n")
+
+	done := make(chan struct{})
+	go func() {
+		q.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(ackWait):
+		log.Printf("Timed out after %s waiting for invocations in progress\n", ackWait)
+	}
+
+	q.connMutex.Lock()
+	defer q.connMutex.Unlock()
+
+	// Resumed whilst waiting.
+	if q.subscription == nil || !q.isPaused() {
+		return nil
+	}
+
+	// Close keeps the durable, Unsubscribe would remove it.
+	err := q.subscription.Close()
+	q.subscription = nil
+
+	log.Printf("Paused, closed subscription to: %s\n", q.subject)
+
+	return err
+}
+
+// resume subscribes to the queue again after pause.
+func (q *NATSQueue) resume() error {
+	q.pauseMutex.Lock()
+	q.paused = false
+	q.pauseMutex.Unlock()
+
+	q.connMutex.Lock()
+	defer q.connMutex.Unlock()
+
+	if q.conn == nil {
+		return fmt.Errorf("not connected to %s", q.natsURL)
+	}
+
+	if q.subscription != nil {
+		return nil
+	}
+
+	log.Printf("Resuming\n")
+
+	return q.subscribe()
+}
+
+func (q *NATSQueue) isPaused() bool {
+	q.pauseMutex.RLock()
+	defer q.pauseMutex.RUnlock()
+
+	return q.paused
 }
 
 func (q *NATSQueue) closeConnection() error {
@@ -152,9 +468,45 @@ func (q *NATSQueue) closeConnection() error {
 		return fmt.Errorf("q.conn is nil")
 	}
 
-	err := q.conn.Close()
-	close(q.msgChan)
-	close(q.quitCh)
+	if q.subscription != nil {
+		if q.unsubscribeOnClose {
+			log.Printf("Unsubscribing from: %s, removing the durable\n", q.subject)
+			if err := q.subscription.Unsubscribe(); err != nil {
+				log.Printf("Error unsubscribing from %s: %s\n", q.subject, err)
+			}
+		} else if err := q.subscription.Close(); err != nil {
+			log.Printf("Error closing subscription to %s: %s\n", q.subject, err)
+		}
+
+		q.subscription = nil
+	}
+
+	err := q.manager.Close()
+	if q.closed != nil {
+		select {
+		case <-q.closed:
+		default:
+			close(q.closed)
+		}
+	}
 
 	return err
 }
+
+// publish sends data to a NATS subject, or to a NATS Streaming channel when
+// streaming is true.
+func (q *NATSQueue) publish(subject string, streaming bool, data []byte) error {
+	q.connMutex.RLock()
+	conn := q.conn
+	q.connMutex.RUnlock()
+
+	if conn == nil {
+		return fmt.Errorf("not connected to %s", q.natsURL)
+	}
+
+	if streaming {
+		return conn.Publish(subject, data)
+	}
+
+	return conn.NatsConn().Publish(subject, data)
+}
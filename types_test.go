@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	stand "github.com/nats-io/nats-streaming-server/server"
+	stan "github.com/nats-io/stan.go"
+	"github.com/openfaas/nats-queue-worker/nats"
+)
+
+const testClusterID = "test-cluster"
+
+// runTestServer starts NATS Streaming on a random port.
+func runTestServer(t *testing.T) *stand.StanServer {
+	t.Helper()
+
+	opts := stand.GetDefaultOptions()
+	opts.ID = testClusterID
+
+	s, err := stand.RunServerWithOpts(opts, &natsserver.Options{
+		Host:   "127.0.0.1",
+		Port:   -1,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatalf("unable to start NATS Streaming: %s", err)
+	}
+	t.Cleanup(s.Shutdown)
+
+	return s
+}
+
+// newTestNATSQueue returns a queue subscribed to subject on s, which handles
+// up to maxInFlight messages at once with handler.
+func newTestNATSQueue(t *testing.T, s *stand.StanServer, subject string, maxInFlight int, handler func(*stan.Msg) bool) *NATSQueue {
+	t.Helper()
+
+	q := &NATSQueue{
+		clusterID:      testClusterID,
+		clientID:       "test-worker",
+		natsURL:        s.ClientURL(),
+		connMutex:      &sync.RWMutex{},
+		events:         nats.NewEvents(),
+		subject:        subject,
+		qgroup:         "faas",
+		messageHandler: handler,
+		maxInFlight:    maxInFlight,
+		ackWait:        time.Second,
+	}
+
+	if err := q.connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.closeConnection() })
+
+	return q
+}
+
+func Test_NATSQueue_RedeliversUnhandledMessages(t *testing.T) {
+	s := runTestServer(t)
+
+	deliveries := make(chan *stan.Msg, 4)
+	newTestNATSQueue(t, s, "faas-request", 1, func(msg *stan.Msg) bool {
+		deliveries <- msg
+
+		// Leave the first delivery for redelivery.
+		return msg.Redelivered
+	})
+
+	publisher, err := stan.Connect(testClusterID, "test-publisher", stan.NatsURL(s.ClientURL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	if err := publisher.Publish("faas-request", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, redelivered := range []bool{false, true} {
+		select {
+		case msg := <-deliveries:
+			if msg.Redelivered != redelivered {
+				t.Fatalf("want redelivered: %t, got %t", redelivered, msg.Redelivered)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for delivery, redelivered: %t", redelivered)
+		}
+	}
+
+	// Acked once handled, so it isn't delivered again.
+	select {
+	case msg := <-deliveries:
+		t.Fatalf("want no delivery once acked, got redelivery %d", msg.RedeliveryCount)
+	case <-time.After(2500 * time.Millisecond):
+	}
+}
+
+func Test_outgrown(t *testing.T) {
+	cases := []struct {
+		workers, inFlight int
+		want              bool
+	}{
+		{8, 8, false},
+		{5, 8, false},
+		{4, 8, true},
+		{15, 8, false},
+		{16, 8, true},
+	}
+
+	for _, c := range cases {
+		if got := outgrown(c.workers, c.inFlight); got != c.want {
+			t.Errorf("%d workers with MaxInflight %d: want %t, got %t", c.workers, c.inFlight, c.want, got)
+		}
+	}
+}
+
+func Test_NATSQueue_setWorkerLimit_Resubscribes(t *testing.T) {
+	s := runTestServer(t)
+
+	q := newTestNATSQueue(t, s, "faas-request", 8, func(msg *stan.Msg) bool {
+		return true
+	})
+
+	inFlight := func() int {
+		q.connMutex.RLock()
+		defer q.connMutex.RUnlock()
+
+		return q.subscribedInFlight
+	}
+
+	waitFor := func(want int) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for inFlight() != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if got := inFlight(); got != want {
+			t.Fatalf("want MaxInflight %d, got %d", want, got)
+		}
+	}
+
+	if got := inFlight(); got != 8 {
+		t.Fatalf("want MaxInflight of maxInFlight, got %d", got)
+	}
+
+	q.setWorkerLimit(2)
+	waitFor(2)
+
+	// Less than double isn't worth pausing for.
+	q.setWorkerLimit(3)
+	time.Sleep(100 * time.Millisecond)
+	if got := inFlight(); got != 2 {
+		t.Fatalf("want MaxInflight kept at 2, got %d", got)
+	}
+
+	q.setWorkerLimit(8)
+	waitFor(8)
+
+	if q.isPaused() {
+		t.Error("want the queue resumed")
+	}
+}
+
+func Test_NATSQueue_closeConnection_WithMessageWaitingForWorker(t *testing.T) {
+	s := runTestServer(t)
+
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	q := newTestNATSQueue(t, s, "faas-request", 4, func(msg *stan.Msg) bool {
+		started <- struct{}{}
+		<-release
+		return true
+	})
+	defer close(release)
+
+	// Fewer workers than MaxInflight, so the 4th message waits for one.
+	q.setWorkerLimit(3)
+
+	publisher, err := stan.Connect(testClusterID, "test-publisher", stan.NatsURL(s.ClientURL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := publisher.Publish("faas-request", []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the workers")
+		}
+	}
+
+	// Let the 4th message reach the subscription's handler.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := q.closeConnection(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.inflight.Wait()
+		close(done)
+	}()
+
+	release <- struct{}{}
+	release <- struct{}{}
+	release <- struct{}{}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want the waiting message given up once closed")
+	}
+}
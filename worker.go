@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	stan "github.com/nats-io/stan.go"
+	ftypes "github.com/openfaas/faas-provider/types"
+	"github.com/openfaas/nats-queue-worker/lifecycle"
+)
+
+// worker invokes functions for the messages received from NATS Streaming
+// and posts their results to the callback URL, if one was given.
+type worker struct {
+	client *http.Client
+
+	// configMutex guards the settings which can be reloaded.
+	configMutex    sync.RWMutex
+	config         QueueWorkerConfig
+	callbackClient *http.Client
+	namespaces     *namespacePolicy
+	functions      *functionPolicy
+
+	// results publishes results to NATS when the callback is a subject.
+	results resultPublisher
+
+	// store keeps results for clients to fetch by their X-Call-Id.
+	store ResultStore
+
+	// status tracks the lifecycle of invocations by their X-Call-Id.
+	status *statusTracker
+
+	// breakers stop functions which keep failing from being invoked.
+	breakers *circuitBreakers
+
+	// gateway leaves messages unacked whilst the gateway is unhealthy.
+	gateway *gatewayMonitor
+
+	// coldStart waits for functions which were scaled to zero to become
+	// ready, it is nil unless cold_start_wait is set.
+	coldStart *coldStartWaiter
+
+	// concurrency adjusts the number of concurrent invocations when
+	// adaptive_concurrency is enabled.
+	concurrency *adaptiveLimiter
+
+	counter uint64
+
+	invocationsMutex sync.Mutex
+	invocations      map[uint64]Invocation
+}
+
+// Invocation is a function invocation in progress.
+type Invocation struct {
+	ID       uint64    `json:"id"`
+	Function string    `json:"function"`
+	CallID   string    `json:"callId,omitempty"`
+	Started  time.Time `json:"started"`
+	Age      string    `json:"age"`
+}
+
+func newWorker(config QueueWorkerConfig, client, callbackClient *http.Client) *worker {
+	return &worker{
+		config:         config,
+		client:         client,
+		callbackClient: callbackClient,
+		namespaces:     newNamespacePolicy(config),
+		functions:      newFunctionPolicy(config),
+		breakers:       newCircuitBreakers(config.CircuitBreaker),
+		coldStart:      newColdStartWaiter(config, client),
+		invocations:    map[uint64]Invocation{},
+	}
+}
+
+// Config returns the config in use.
+func (w *worker) Config() QueueWorkerConfig {
+	w.configMutex.RLock()
+	defer w.configMutex.RUnlock()
+
+	return w.config
+}
+
+// Reload applies a new config to invocations which start after it returns.
+func (w *worker) Reload(config QueueWorkerConfig, callbackClient *http.Client) {
+	namespaces := newNamespacePolicy(config)
+	functions := newFunctionPolicy(config)
+	coldStart := newColdStartWaiter(config, w.client)
+
+	w.configMutex.Lock()
+	defer w.configMutex.Unlock()
+
+	carrySlots(namespaces.slots, w.namespaces.slots)
+	carrySlots(functions.slots, w.functions.slots)
+
+	w.config = config
+	w.callbackClient = callbackClient
+	w.namespaces = namespaces
+	w.functions = functions
+	w.coldStart = coldStart
+
+	w.breakers.Configure(config.CircuitBreaker)
+
+	if w.concurrency != nil {
+		w.concurrency.Configure(config.AdaptiveConcurrency, config.MaxInflight)
+	}
+}
+
+// Invocations returns the invocations in progress, oldest first.
+func (w *worker) Invocations() []Invocation {
+	w.invocationsMutex.Lock()
+	defer w.invocationsMutex.Unlock()
+
+	invocations := make([]Invocation, 0, len(w.invocations))
+	for _, invocation := range w.invocations {
+		invocation.Age = time.Since(invocation.Started).Round(time.Millisecond).String()
+		invocations = append(invocations, invocation)
+	}
+
+	sort.Slice(invocations, func(i, j int) bool {
+		return invocations[i].Started.Before(invocations[j].Started)
+	})
+
+	return invocations
+}
+
+func (w *worker) track(invocation Invocation) func() {
+	w.invocationsMutex.Lock()
+	w.invocations[invocation.ID] = invocation
+	w.invocationsMutex.Unlock()
+
+	return func() {
+		w.invocationsMutex.Lock()
+		delete(w.invocations, invocation.ID)
+		w.invocationsMutex.Unlock()
+	}
+}
+
+// handle processes a single message from the queue, it returns false when
+// the message should not be acked, so that it is redelivered after ack_wait.
+func (w *worker) handle(msg *stan.Msg) bool {
+	w.configMutex.RLock()
+	config := w.config
+	callbackClient := w.callbackClient
+	namespaces := w.namespaces
+	functions := w.functions
+	coldStart := w.coldStart
+	w.configMutex.RUnlock()
+
+	i := atomic.AddUint64(&w.counter, 1)
+
+	log.Printf("[#%d] Received on [%s]: '%s'", i, msg.Subject, msg)
+
+	started := time.Now()
+
+	req := ftypes.QueueRequest{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Printf("[#%d] Unmarshal error: %s with data %s", i, err, msg.Data)
+		return true
+	}
+
+	xCallID := req.Header.Get("X-Call-Id")
+
+	if w.gateway != nil && !w.gateway.Healthy() {
+		log.Printf("[#%d] Gateway is unhealthy, leaving %s for redelivery", i, req.Function)
+		return false
+	}
+
+	if msg.Redelivered {
+		w.recordStatus(xCallID, req.Function, lifecycle.Retrying, 0, fmt.Sprintf("redelivery %d", msg.RedeliveryCount))
+	} else {
+		w.recordStatus(xCallID, req.Function, lifecycle.Received, 0, "")
+	}
+
+	name, namespace := splitFunctionName(strings.Trim(req.Function, "/"), config.DefaultNamespace)
+	if !namespaces.Allowed(namespace) {
+		log.Printf("[#%d] Rejected: %s, namespace %s is not allowed", i, req.Function, namespace)
+		rejectedTotal.WithLabelValues(namespace, "namespace").Inc()
+		w.recordStatus(xCallID, req.Function, lifecycle.Failed, 0, "namespace not allowed")
+		return true
+	}
+
+	if config.MessageTTL > 0 {
+		if age := time.Since(time.Unix(0, msg.Timestamp)); age > config.MessageTTL {
+			log.Printf("[#%d] Expired: %s was queued %s ago, message_ttl: %s", i, req.Function, age.Round(time.Second), config.MessageTTL)
+			rejectedTotal.WithLabelValues(namespace, "expired").Inc()
+			w.recordStatus(xCallID, req.Function, lifecycle.Expired, 0, fmt.Sprintf("queued %s ago", age.Round(time.Second)))
+			return true
+		}
+	}
+
+	settings := namespaces.Settings(namespace)
+	functionKey, function := functions.Lookup(name, namespace)
+
+	release, ok := namespaces.Acquire(namespace, slotWait(config.AckWait))
+	if !ok {
+		log.Printf("[#%d] Namespace %s is at its max_inflight, leaving %s for redelivery", i, namespace, req.Function)
+		rejectedTotal.WithLabelValues(namespace, "namespace_busy").Inc()
+		return false
+	}
+	defer release()
+
+	releaseFunction, ok := functions.Acquire(functionKey, slotWait(config.AckWait))
+	if !ok {
+		log.Printf("[#%d] %s is at its max_inflight, leaving it for redelivery", i, req.Function)
+		rejectedTotal.WithLabelValues(namespace, "function_busy").Inc()
+		return false
+	}
+	defer releaseFunction()
+
+	// Allowed once the slots are held, as a half-open circuit's trial is
+	// only given back by Record.
+	circuit := strings.Trim(req.Function, "/")
+	if !w.breakers.Allow(circuit, time.Now()) {
+		return w.deferMessage(i, msg, &req, namespace, config.CircuitBreaker.HoldingChannel)
+	}
+
+	storeResult := w.store != nil && len(xCallID) > 0
+	if storeResult {
+		w.storeResult(i, StoredResult{
+			CallID:       xCallID,
+			Status:       resultPending,
+			FunctionName: req.Function,
+			ReceivedAt:   started,
+		})
+	}
+
+	inflight.WithLabelValues(namespace).Inc()
+	defer inflight.WithLabelValues(namespace).Dec()
+
+	defer w.track(Invocation{
+		ID:       i,
+		Function: req.Function,
+		CallID:   xCallID,
+		Started:  time.Now(),
+	})()
+
+	functionURL := makeFunctionURL(&req, &config, req.Path, req.QueryString)
+	fmt.Printf("[#%d] Invoking: %s (namespace: %s) with %d bytes, via: %s", i, name, namespace, len(req.Body), functionURL)
+
+	if config.DebugPrintBody {
+		fmt.Println(string(req.Body))
+	}
+
+	timeout := settings.Timeout
+	if function.Timeout > 0 {
+		timeout = function.Timeout
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, functionURL, bytes.NewReader(req.Body))
+	if err != nil {
+		log.Printf("[#%d] Unable to post message due to invalid URL, error: %s", i, err.Error())
+		w.breakers.Record(circuit, false, time.Now())
+		return true
+	}
+
+	req.Header.Set("User-Agent", "openfaas-ce/nats-queue-worker")
+
+	defer request.Body.Close()
+	copyHeaders(request.Header, &req.Header)
+
+	w.recordStatus(xCallID, req.Function, lifecycle.Invoking, 0, "")
+
+	res, err := w.invoke(ctx, i, request, &req, function, coldStart)
+
+	var status int
+
+	var statusCode int
+	if err != nil {
+		statusCode = http.StatusServiceUnavailable
+	} else {
+		statusCode = res.StatusCode
+	}
+
+	duration := time.Since(start)
+
+	log.Printf("[#%d] Invoked: %s (namespace: %s) [%d] in %fs", i, name, namespace, statusCode, duration.Seconds())
+
+	w.breakers.Record(circuit, err == nil && statusCode < 500, time.Now())
+
+	if w.concurrency != nil {
+		w.concurrency.Observe(duration, statusCode, err, time.Now())
+	}
+
+	invocationsTotal.WithLabelValues(name, namespace, strconv.Itoa(statusCode)).Inc()
+	invocationDuration.WithLabelValues(name, namespace).Observe(duration.Seconds())
+
+	if w.gateway != nil {
+		w.gateway.Observe(res, err)
+
+		// Once sent, the function may have run, so the result is handled
+		// as any other rather than the function being invoked again.
+		if notSent(err) && !w.gateway.Healthy() {
+			log.Printf("[#%d] Gateway is unhealthy, leaving %s for redelivery", i, req.Function)
+			return false
+		}
+	}
+
+	if err != nil {
+		w.recordStatus(xCallID, req.Function, lifecycle.Failed, statusCode, err.Error())
+	} else if statusCode >= 200 && statusCode < 300 {
+		w.recordStatus(xCallID, req.Function, lifecycle.Succeeded, statusCode, "")
+	} else {
+		w.recordStatus(xCallID, req.Function, lifecycle.Failed, statusCode, "")
+	}
+
+	callbackURL := req.CallbackURL
+	if callbackURL == nil {
+		callbackURL = function.CallbackURL
+	}
+
+	subject, streaming := resultSubject(&req)
+	if len(subject) > 0 {
+		callbackURL = nil
+	}
+
+	if (callbackURL != nil || len(subject) > 0) && (settings.DisableCallbacks || function.DisableCallbacks) {
+		log.Printf("[#%d] Callbacks are disabled for: %s (namespace: %s), not sending result", i, name, namespace)
+		callbackURL = nil
+		subject = ""
+	}
+
+	if callbackURL != nil {
+		if err := config.CallbackPolicy.CheckURL(callbackURL); err != nil {
+			log.Printf("[#%d] Not posting result to: %s, %s", i, callbackURL.String(), err)
+			callbacksRejectedTotal.WithLabelValues(namespace).Inc()
+			callbackURL = nil
+		}
+	}
+
+	if len(subject) > 0 {
+		if err := config.CallbackPolicy.CheckSubject(subject); err != nil {
+			log.Printf("[#%d] Not publishing result to: %s, %s", i, subject, err)
+			callbacksRejectedTotal.WithLabelValues(namespace).Inc()
+			subject = ""
+		}
+	}
+
+	if err != nil {
+		status = http.StatusServiceUnavailable
+
+		log.Printf("[#%d] Error invoking %s, error: %s", i, req.Function, err)
+
+		timeTaken := time.Since(started).Seconds()
+
+		if callbackURL != nil {
+			resultStatusCode, err := postResult(callbackClient,
+				res,
+				nil,
+				nil,
+				callbackURL.String(),
+				xCallID,
+				status,
+				req.Function,
+				timeTaken)
+
+			if err != nil {
+				w.countRejectedCallback(err, namespace)
+				log.Printf("[#%d] Posted callback to: %s - status %d, error: %s", i, callbackURL.String(), http.StatusServiceUnavailable, err.Error())
+			} else {
+				log.Printf("[#%d] Posted result to %s - status: %d", i, callbackURL.String(), resultStatusCode)
+			}
+		}
+
+		if len(subject) > 0 {
+			w.publishResult(i, subject, streaming, res, nil, nil, xCallID, status, req.Function, timeTaken)
+		}
+
+		if storeResult {
+			w.storeResult(i, StoredResult{
+				CallID:       xCallID,
+				Status:       resultComplete,
+				FunctionName: req.Function,
+				StatusCode:   status,
+				ReceivedAt:   started,
+				CompletedAt:  time.Now(),
+				TimeTaken:    timeTaken,
+			})
+		}
+
+		return true
+	}
+
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+
+	body := newLimitedReader(res.Body, config.MaxResponseSize)
+
+	// Results published to NATS or stored are always buffered.
+	stream := config.StreamResponse && len(subject) == 0 && !storeResult
+
+	var functionResult []byte
+	var result io.Reader = body
+	if !stream {
+		functionResult, err = io.ReadAll(body)
+		if err != nil {
+			log.Printf("[#%d] Error reading body for: %s, error: %s", i, req.Function, err)
+		}
+
+		if config.WriteDebug {
+			fmt.Println(string(functionResult))
+		} else {
+			fmt.Printf("[#%d] %s returned %d bytes", i, req.Function, len(functionResult))
+		}
+
+		result = bytes.NewReader(functionResult)
+	}
+
+	timeTaken := time.Since(started).Seconds()
+
+	if callbackURL != nil {
+		log.Printf("[#%d] Callback to: %s", i, callbackURL.String())
+
+		resultStatusCode, err := postResult(callbackClient,
+			res,
+			result,
+			body,
+			callbackURL.String(),
+			xCallID,
+			res.StatusCode,
+			req.Function,
+			timeTaken)
+
+		if err != nil {
+			w.countRejectedCallback(err, namespace)
+			log.Printf("[#%d] Error posting to callback-url: %s", i, err)
+		} else {
+			log.Printf("[#%d] Posted result for %s to callback-url: %s, status: %d", i, req.Function, callbackURL.String(), resultStatusCode)
+		}
+	} else if stream {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			log.Printf("[#%d] Error reading body for: %s, error: %s", i, req.Function, err)
+		}
+	}
+
+	if len(subject) > 0 {
+		w.publishResult(i, subject, streaming, res, functionResult, body, xCallID, res.StatusCode, req.Function, timeTaken)
+	}
+
+	if storeResult {
+		header := http.Header{}
+		copyHeaders(header, &res.Header)
+		body.setHeaders(header)
+
+		w.storeResult(i, StoredResult{
+			CallID:       xCallID,
+			Status:       resultComplete,
+			FunctionName: req.Function,
+			StatusCode:   res.StatusCode,
+			Header:       header,
+			Body:         functionResult,
+			ReceivedAt:   started,
+			CompletedAt:  time.Now(),
+			TimeTaken:    timeTaken,
+		})
+	}
+
+	if stream {
+		fmt.Printf("[#%d] %s streamed %d bytes", i, req.Function, body.n)
+	}
+
+	if body.truncated {
+		log.Printf("[#%d] Response from %s truncated to max_response_size: %d bytes", i, req.Function, config.MaxResponseSize)
+	}
+
+	return true
+}
+
+// invoke sends the request to the function, retrying it on a new request
+// when the function can't be reached or is overloaded, for as many times as
+// the function's settings allow. When coldStart is set, a function which
+// responds as if it's scaled to zero is waited for and invoked again, which
+// doesn't count as a retry.
+func (w *worker) invoke(ctx context.Context, i uint64, request *http.Request, req *ftypes.QueueRequest, function FunctionConfig, coldStart *coldStartWaiter) (*http.Response, error) {
+	waited := false
+
+	for attempt := 1; ; attempt++ {
+		res, err := w.client.Do(request)
+
+		if coldStart != nil && !waited && coldStartResponse(res, err) {
+			waited = true
+
+			if w.waitForColdStart(ctx, i, coldStart, req, res.StatusCode) {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+
+				next := request.Clone(ctx)
+				next.Body = io.NopCloser(bytes.NewReader(req.Body))
+				request = next
+
+				attempt--
+				continue
+			}
+		}
+
+		if attempt > function.Retries || !retryable(res, err) {
+			return res, err
+		}
+
+		statusCode := http.StatusServiceUnavailable
+		if err == nil {
+			statusCode = res.StatusCode
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		log.Printf("[#%d] Retrying %s (%d/%d) in %s, status: %d", i, req.Function, attempt, function.Retries, function.RetryDelay, statusCode)
+		w.recordStatus(req.Header.Get("X-Call-Id"), req.Function, lifecycle.Retrying, statusCode, fmt.Sprintf("retry %d of %d", attempt, function.Retries))
+
+		select {
+		case <-time.After(function.RetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		next := request.Clone(ctx)
+		next.Body = io.NopCloser(bytes.NewReader(req.Body))
+		request = next
+	}
+}
+
+// waitForColdStart returns true once the function is ready to be invoked
+// again after it responded with statusCode.
+func (w *worker) waitForColdStart(ctx context.Context, i uint64, coldStart *coldStartWaiter, req *ftypes.QueueRequest, statusCode int) bool {
+	log.Printf("[#%d] %s returned %d, waiting up to %s for it to become ready", i, req.Function, statusCode, coldStart.wait)
+	w.recordStatus(req.Header.Get("X-Call-Id"), req.Function, lifecycle.Retrying, statusCode, "waiting for cold start")
+
+	start := time.Now()
+	if err := coldStart.Wait(ctx, req.Function); err != nil {
+		log.Printf("[#%d] Gave up waiting for %s to become ready: %s", i, req.Function, err)
+		coldStartsTotal.WithLabelValues("not_ready").Inc()
+		return false
+	}
+
+	log.Printf("[#%d] %s became ready in %s", i, req.Function, time.Since(start).Round(time.Millisecond))
+	coldStartsTotal.WithLabelValues("ready").Inc()
+	coldStartDuration.Observe(time.Since(start).Seconds())
+
+	return true
+}
+
+// deferMessage is used whilst a function's circuit is open, the message is
+// moved to the holding channel, or otherwise left unacked to be redelivered.
+func (w *worker) deferMessage(i uint64, msg *stan.Msg, req *ftypes.QueueRequest, namespace, holdingChannel string) bool {
+	rejectedTotal.WithLabelValues(namespace, "circuit_open").Inc()
+
+	if len(holdingChannel) == 0 || w.results == nil {
+		log.Printf("[#%d] Circuit open for %s, deferring for redelivery", i, req.Function)
+		return false
+	}
+
+	if err := w.results.publish(holdingChannel, true, msg.Data); err != nil {
+		log.Printf("[#%d] Circuit open for %s, unable to move to: %s, deferring for redelivery, error: %s", i, req.Function, holdingChannel, err)
+		return false
+	}
+
+	log.Printf("[#%d] Circuit open for %s, moved to: %s", i, req.Function, holdingChannel)
+	w.recordStatus(req.Header.Get("X-Call-Id"), req.Function, lifecycle.DeadLettered, 0, fmt.Sprintf("circuit open, moved to %s", holdingChannel))
+
+	return true
+}
+
+// countRejectedCallback records callbacks which were stopped by the callback
+// policy whilst connecting or following a redirect.
+func (w *worker) countRejectedCallback(err error, namespace string) {
+	var rejected *callbackRejectedError
+	if errors.As(err, &rejected) {
+		callbacksRejectedTotal.WithLabelValues(namespace).Inc()
+	}
+}
+
+// publishResult sends the result of an invocation to a NATS subject, or a NATS
+// Streaming channel when streaming is true.
+func (w *worker) publishResult(i uint64, subject string, streaming bool, functionRes *http.Response, result []byte, body *limitedReader,
+	xCallID string, statusCode int, functionName string, timeTaken float64) {
+
+	if w.results == nil {
+		log.Printf("[#%d] Unable to publish result to: %s, no publisher available", i, subject)
+		return
+	}
+
+	data, err := marshalResult(functionRes, result, body, xCallID, statusCode, functionName, timeTaken)
+	if err != nil {
+		log.Printf("[#%d] Unable to marshal result for: %s, error: %s", i, functionName, err)
+		return
+	}
+
+	if err := w.results.publish(subject, streaming, data); err != nil {
+		log.Printf("[#%d] Error publishing result to: %s, error: %s", i, subject, err)
+		return
+	}
+
+	log.Printf("[#%d] Published result for %s to: %s (%d bytes)", i, functionName, subject, len(data))
+}
+
+func (w *worker) storeResult(i uint64, result StoredResult) {
+	if err := w.store.Put(result); err != nil {
+		log.Printf("[#%d] Error storing result for: %s, error: %s", i, result.CallID, err)
+	}
+}
+
+// recordStatus records a lifecycle transition when status tracking is enabled
+// and the request has an X-Call-Id.
+func (w *worker) recordStatus(xCallID, function string, state lifecycle.State, statusCode int, message string) {
+	if w.status == nil || len(xCallID) == 0 {
+		return
+	}
+
+	w.status.Record(xCallID, function, state, statusCode, message)
+}